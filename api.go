@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/webdevops/azure-scheduledevents-exporter/config"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// max body bytes included in error messages of failed API calls
+	apiErrorBodyLimit = 512
+
+	// max body bytes logged in debug mode
+	apiDebugBodyLimit = 4096
+
+	// min remaining time before --api-retry-count deadline for another attempt
+	apiMinAttemptTime = 500 * time.Millisecond
+
+	// path of default API URL (used with --api-host), api-version is set by --api-version
+	apiDefaultPath = "/metadata/scheduledevents?api-version=2017-11-01"
+
+	// IMDS instance metadata (--require-azure)
+	azureInstanceMetadataPath       = "/metadata/instance"
+	azureInstanceMetadataApiVersion = "2021-02-01"
+)
+
+var (
+	// ErrNetwork is returned for failed connections and requests (including timeouts)
+	ErrNetwork = errors.New("network error")
+
+	// ErrHTTPStatus is returned for unexpected HTTP status codes
+	ErrHTTPStatus = errors.New("unexpected http status")
+
+	// ErrDecode is returned for malformed API responses
+	ErrDecode = errors.New("decode error")
+)
+
+// ApiError is a failed API call, matches its kind (ErrNetwork, ErrHTTPStatus, ErrDecode) via errors.Is
+type ApiError struct {
+	Kind error
+	Err  error
+}
+
+func (e *ApiError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ApiError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ApiError) Is(target error) bool {
+	return target == e.Kind
+}
+
+type AzureScheduledEventResponse struct {
+	DocumentIncarnation int                   `json:"DocumentIncarnation"`
+	Events              []AzureScheduledEvent `json:"Events"`
+}
+
+type AzureScheduledEvent struct {
+	EventId      string   `json:"EventId"`
+	EventType    string   `json:"EventType"`
+	ResourceType string   `json:"ResourceType"`
+	Resources    []string `json:"Resources"`
+	EventStatus  string   `json:"EventStatus"`
+	EventSource  string   `json:"EventSource"`
+	NotBefore    string   `json:"NotBefore"`
+	Description  string   `json:"Description"`
+	// expected impact duration, -1 if unknown (also if missing)
+	DurationInSeconds int `json:"DurationInSeconds"`
+}
+
+// decodes event, missing DurationInSeconds (older API versions) is decoded as -1 instead of 0
+func (e *AzureScheduledEvent) UnmarshalJSON(data []byte) error {
+	type rawEvent AzureScheduledEvent
+	event := rawEvent{DurationInSeconds: -1}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	*e = AzureScheduledEvent(event)
+	return nil
+}
+
+// ApiTarget is an Azure ScheduledEvents API endpoint with its collection state
+type ApiTarget struct {
+	// effective API URL (also used as target label)
+	Url string
+
+	// consecutive failed API calls (only accessed by probe)
+	errorCount int
+
+	// failed API calls within --api-error-window (only accessed by probe)
+	errorTimes []time.Time
+
+	// time of last API call (only accessed by probe)
+	lastFetchTime time.Time
+
+	// successful API call since startup (only accessed by probe)
+	fetchSucceeded bool
+
+	// EventIds of last successful scrape (only accessed by probe)
+	seenEventIds map[string]bool
+
+	// resource types exported by previous scrapes (only accessed by probe)
+	resourceTypes map[string]bool
+
+	// EventIds approved (or logged by --approve-dry-run) in approvedIncarnation and due times of postponed
+	// approvals (only accessed by probe)
+	approvedEventIds    map[string]bool
+	dryRunEventIds      map[string]bool
+	approveDueTimes     map[string]time.Time
+	approvedIncarnation int
+
+	// events of last successful scrapes by EventId for --event-retention (only accessed by probe)
+	retainedEvents map[string]*retainedEvent
+
+	// disruptive events (event type causing node cordon) of last successful scrape, node is only cordoned
+	// if one of them affects this VM (only accessed by probe)
+	disruptiveEvents []AzureScheduledEvent
+
+	// protected by collectionLock
+	lastDocumentIncarnation int
+	documentIncarnationSeen bool
+	// time of last document incarnation change (first successful scrape until first change)
+	documentIncarnationChangeTime time.Time
+	// time of last successful scrape (startup time until first success)
+	lastSuccessTime time.Time
+	// unfiltered API response of last successful API call (served via /events)
+	lastResponse     *AzureScheduledEventResponse
+	lastResponseTime time.Time
+}
+
+// events of EventId and time of last scrape containing the EventId
+type retainedEvent struct {
+	events   []AzureScheduledEvent
+	lastSeen time.Time
+}
+
+var (
+	apiTargets []*ApiTarget
+
+	httpClient *http.Client
+
+	timeFormatList = []string{
+		time.RFC3339,
+		time.RFC3339Nano,
+		time.RFC1123,
+		time.RFC1123Z,
+		time.RFC822Z,
+		time.RFC850,
+		// without zone offset (parsed as UTC)
+		"2006-01-02T15:04:05.999999999",
+		"2006-01-02 15:04:05",
+	}
+
+	// --api-bearer-token-file, token is re-read if file has changed (requests of approvals can run concurrently)
+	apiBearerTokenLock    sync.Mutex
+	apiBearerToken        string
+	apiBearerTokenModTime time.Time
+	apiBearerTokenSize    int64
+)
+
+// registers failed API call, returns failed calls relevant for --api-error-threshold
+// (consecutive failures or failures within --api-error-window)
+func (t *ApiTarget) registerError() int {
+	t.errorCount++
+	if opts.ApiErrorWindow <= 0 {
+		return t.errorCount
+	}
+
+	now := time.Now()
+	errorTimes := []time.Time{}
+	for _, errorTime := range t.errorTimes {
+		if now.Sub(errorTime) < opts.ApiErrorWindow {
+			errorTimes = append(errorTimes, errorTime)
+		}
+	}
+	t.errorTimes = append(errorTimes, now)
+
+	return len(t.errorTimes)
+}
+
+func setupHttpClient() {
+	// seed random per process (used for retry and startup jitter)
+	rand.Seed(time.Now().UnixNano())
+
+	// Init http client (timeout is handled by request context)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.MaxIdleConns = opts.ApiMaxIdleConns
+	transport.IdleConnTimeout = opts.ApiIdleConnTimeout
+
+	// IMDS is plain HTTP/1.1, disable HTTP/2
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+	// --api-tls.cert, --api-tls.key, --api-tls.ca (validated at startup)
+	tlsConfig, err := loadApiTlsConfig(&opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	transport.TLSClientConfig = tlsConfig
+	if opts.ApiNoProxy {
+		transport.Proxy = nil
+	}
+
+	// --api-interface: connections are bound to address of interface
+	if opts.ApiInterface != "" {
+		transport.DialContext = apiInterfaceDialContext(opts.ApiInterface)
+	}
+
+	// --api-unix-socket: all connections are dialed to socket, host of API URL is only used for requests
+	if opts.ApiUnixSocket != "" {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, "unix", opts.ApiUnixSocket)
+		}
+	}
+
+	httpClient = &http.Client{
+		Transport: transport,
+	}
+}
+
+// returns dialer which binds connections to address of interface (matching address family of remote address),
+// link-local IPv6 addresses without zone are scoped to interface
+func apiInterfaceDialContext(ifaceName string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		zone := zoneOfAddress(host)
+		remoteIp := net.ParseIP(strings.TrimSuffix(host, "%"+zone))
+		if remoteIp == nil {
+			// hostname, resolve to first address
+			ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+			if err != nil {
+				return nil, err
+			}
+			remoteIp = ips[0]
+		}
+
+		localIp, err := interfaceAddress(ifaceName, remoteIp.To4() == nil, remoteIp.IsLinkLocalUnicast())
+		if err != nil {
+			return nil, err
+		}
+
+		remoteAddr := &net.TCPAddr{IP: remoteIp, Zone: zone}
+		localAddr := &net.TCPAddr{IP: localIp}
+		if remoteIp.To4() == nil && remoteIp.IsLinkLocalUnicast() {
+			localAddr.Zone = ifaceName
+			if remoteAddr.Zone == "" {
+				remoteAddr.Zone = ifaceName
+			}
+		}
+		remoteAddr.Port, err = net.LookupPort(network, port)
+		if err != nil {
+			return nil, err
+		}
+
+		dialer := net.Dialer{LocalAddr: localAddr}
+		return dialer.DialContext(ctx, network, remoteAddr.String())
+	}
+}
+
+// returns address of interface, prefers link-local addresses if linkLocal is set (only for IPv6)
+func interfaceAddress(ifaceName string, ipv6, linkLocal bool) (net.IP, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() == nil) != ipv6 {
+			continue
+		}
+
+		if ret == nil || (ipv6 && linkLocal && ipNet.IP.IsLinkLocalUnicast() && !ret.IsLinkLocalUnicast()) {
+			ret = ipNet.IP
+		}
+	}
+
+	if ret == nil {
+		family := "IPv4"
+		if ipv6 {
+			family = "IPv6"
+		}
+		return nil, fmt.Errorf("interface \"%v\" has no %v address", ifaceName, family)
+	}
+	return ret, nil
+}
+
+// returns zone of scoped IPv6 address (eg. eth0 for fe80::1%eth0)
+func zoneOfAddress(host string) string {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		return host[i+1:]
+	}
+	return ""
+}
+
+// builds TLS config for Azure API requests (client certificate and custom CA for metadata proxies)
+func loadApiTlsConfig(o *config.Opts) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if o.ApiClientCertFile != "" || o.ApiClientKeyFile != "" {
+		if o.ApiClientCertFile == "" || o.ApiClientKeyFile == "" {
+			return nil, errors.New("--api-tls.cert, --api-tls.key: both must be set for client certificate authentication")
+		}
+
+		clientCert, err := tls.LoadX509KeyPair(o.ApiClientCertFile, o.ApiClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("--api-tls.cert, --api-tls.key: unable to load client certificate/key: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	if o.ApiCACertFile != "" {
+		caCert, err := ioutil.ReadFile(o.ApiCACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("--api-tls.ca: unable to read CA file: %w", err)
+		}
+
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("--api-tls.ca: no valid PEM certificates found in \"%v\"", o.ApiCACertFile)
+		}
+		tlsConfig.RootCAs = caPool
+	}
+
+	return tlsConfig, nil
+}
+
+func fetchApiUrl(ctx context.Context, apiUrl string) (ret *AzureScheduledEventResponse, err error) {
+	if opts.ApiMockFile != "" {
+		return fetchApiMockFile(ctx, apiUrl)
+	}
+
+	// overall deadline for all attempts, also bounds the running attempt
+	deadline := time.Now().Add(opts.ApiTimeout * time.Duration(opts.ApiRetryCount+1))
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		ret, err = fetchApiUrlOnce(ctx, apiUrl)
+		if err == nil || attempt >= opts.ApiRetryCount {
+			return
+		}
+
+		// retry needs time for delay and at least a minimal attempt
+		delay := apiRetryBackoff(attempt)
+		if time.Now().Add(delay + apiMinAttemptTime).After(deadline) {
+			scrapeLogger(ctx).WithField("url", apiUrl).Debugf("not retrying failed API call, deadline would be exceeded: %v", err)
+			return
+		}
+
+		scrapeLogger(ctx).WithFields(log.Fields{
+			"url":     apiUrl,
+			"attempt": attempt + 1,
+		}).Debugf("failed API call (attempt %v of %v), retrying in %v: %v", attempt+1, opts.ApiRetryCount+1, delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, &ApiError{Kind: ErrNetwork, Err: ctx.Err()}
+		case <-time.After(delay):
+		}
+	}
+}
+
+// --require-azure: checks if Azure instance metadata is reachable (via host of first API URL)
+func checkAzureInstance(ctx context.Context) error {
+	_, err := fetchInstanceMetadata(ctx, "", "")
+	return err
+}
+
+// returns compute name of VM from Azure instance metadata (via host of first API URL)
+func fetchComputeName(ctx context.Context) (string, error) {
+	body, err := fetchInstanceMetadata(ctx, "/compute/name", "text")
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSpace(string(body))
+	if name == "" {
+		return "", errors.New("empty compute name in IMDS instance metadata")
+	}
+	return name, nil
+}
+
+// fetches Azure instance metadata (path relative to /metadata/instance, optional format) from host of first API URL
+func fetchInstanceMetadata(ctx context.Context, path, format string) ([]byte, error) {
+	apiUrl, err := url.Parse(opts.ApiUrl[0])
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"api-version": []string{azureInstanceMetadataApiVersion}}
+	if format != "" {
+		query.Set("format", format)
+	}
+	instanceUrl := url.URL{Scheme: apiUrl.Scheme, Host: apiUrl.Host, Path: azureInstanceMetadataPath + path, RawQuery: query.Encode()}
+
+	// called outside of scrapes (startup, compute name detection), --api-timeout can be changed by config reload
+	ctx, cancel := context.WithTimeout(ctx, currentApiTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", instanceUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := setApiRequestHeaders(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, apiErrorBodyLimit))
+		return nil, fmt.Errorf("unexpected status %v from IMDS instance metadata: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, apiDebugBodyLimit))
+}
+
+// sets headers of Azure API requests, defaults can be overridden by --api-header
+// fails if bearer token (--api-bearer-token-file) is not readable, the request must not be sent without token
+func setApiRequestHeaders(req *http.Request) error {
+	req.Header.Set("Metadata", "true")
+	req.Header.Set("User-Agent", opts.UserAgent)
+
+	if opts.ApiBearerTokenFile != "" {
+		token, err := readApiBearerToken()
+		if err != nil {
+			return fmt.Errorf("--api-bearer-token-file: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	for name, value := range opts.ApiHeaders {
+		req.Header.Set(name, value)
+	}
+	return nil
+}
+
+// returns token of --api-bearer-token-file, file is only re-read if modification time or size has changed (rotation)
+func readApiBearerToken() (string, error) {
+	apiBearerTokenLock.Lock()
+	defer apiBearerTokenLock.Unlock()
+
+	stat, err := os.Stat(opts.ApiBearerTokenFile)
+	if err != nil {
+		return "", err
+	}
+	if apiBearerToken != "" && stat.ModTime().Equal(apiBearerTokenModTime) && stat.Size() == apiBearerTokenSize {
+		return apiBearerToken, nil
+	}
+
+	content, err := ioutil.ReadFile(opts.ApiBearerTokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("token file \"%v\" is empty", opts.ApiBearerTokenFile)
+	}
+
+	if apiBearerToken != "" {
+		log.WithField("file", opts.ApiBearerTokenFile).Infof("bearer token file changed, using new token")
+	}
+	apiBearerToken = token
+	apiBearerTokenModTime = stat.ModTime()
+	apiBearerTokenSize = stat.Size()
+	return token, nil
+}
+
+// calculates exponential backoff delay with jitter for retry attempt
+func apiRetryBackoff(attempt int) time.Duration {
+	delay := opts.ApiRetryDelay * time.Duration(1<<uint(attempt))
+	if delay <= 0 {
+		return 0
+	}
+
+	// jitter: use random delay between 50% and 100% of backoff
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func fetchApiUrlOnce(ctx context.Context, apiUrl string) (*AzureScheduledEventResponse, error) {
+	targetLabels := prometheus.Labels{"target": apiUrl}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.ApiTimeout)
+	defer cancel()
+
+	startTime := time.Now()
+	req, err := http.NewRequestWithContext(ctx, "GET", apiUrl, nil)
+	if err != nil {
+		scheduledEventRequestError.With(targetLabels).Inc()
+		return nil, err
+	}
+	if err := setApiRequestHeaders(req); err != nil {
+		scheduledEventRequestError.With(targetLabels).Inc()
+		return nil, err
+	}
+
+	requestStartTime := time.Now()
+	resp, err := httpClient.Do(req)
+	observeWithExemplar(ctx, scheduledEventApiRequestDuration.With(targetLabels), time.Since(requestStartTime).Seconds())
+	if err != nil {
+		scheduledEventRequestError.With(targetLabels).Inc()
+		return nil, &ApiError{Kind: ErrNetwork, Err: err}
+	}
+	defer func() {
+		// drain body so connection can be reused
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	scrapeLogger(ctx).WithFields(log.Fields{
+		"url":        apiUrl,
+		"statusCode": resp.StatusCode,
+	}).Debugf("received API response with status %v", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		scheduledEventRequestError.With(targetLabels).Inc()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, apiErrorBodyLimit))
+		return nil, &ApiError{Kind: ErrHTTPStatus, Err: fmt.Errorf("unexpected status %v from IMDS: %s", resp.StatusCode, strings.TrimSpace(string(body)))}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		scheduledEventRequestError.With(targetLabels).Inc()
+		return nil, &ApiError{Kind: ErrNetwork, Err: err}
+	}
+
+	ret, err := decodeApiResponse(ctx, apiUrl, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.MetricsRequestStats {
+		duration := time.Since(startTime)
+		scheduledEventRequest.With(targetLabels).Observe(duration.Seconds())
+	}
+
+	return ret, nil
+}
+
+// --dev.api-mock-file: reads API response from local file instead of calling the Azure API (development only)
+func fetchApiMockFile(ctx context.Context, apiUrl string) (*AzureScheduledEventResponse, error) {
+	scrapeLogger(ctx).WithField("url", apiUrl).Debugf("reading API response from mock file \"%v\"", opts.ApiMockFile)
+
+	// file is read on every scrape so it can be changed while running
+	body, err := ioutil.ReadFile(opts.ApiMockFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mock file: %w", err)
+	}
+
+	return decodeApiResponse(ctx, apiUrl, body)
+}
+
+// decodes API response body, empty body is handled as response without events
+func decodeApiResponse(ctx context.Context, apiUrl string, body []byte) (*AzureScheduledEventResponse, error) {
+	ret := &AzureScheduledEventResponse{}
+
+	if log.IsLevelEnabled(log.DebugLevel) {
+		logBody := body
+		if len(logBody) > apiDebugBodyLimit {
+			logBody = logBody[:apiDebugBodyLimit]
+		}
+		scrapeLogger(ctx).WithField("url", apiUrl).Debugf("API response body (%v bytes): %s", len(body), logBody)
+	}
+
+	// IMDS returns empty body (or 204) while ScheduledEvents service is initializing, no events are scheduled
+	if len(bytes.TrimSpace(body)) == 0 {
+		scrapeLogger(ctx).WithField("url", apiUrl).Debugf("received empty API response, assuming no scheduled events")
+		ret.Events = []AzureScheduledEvent{}
+	} else if err := json.Unmarshal(body, &ret); err != nil {
+		// malformed response (eg. truncated during host transition), counted separately from request errors
+		scheduledEventDecodeErrors.With(prometheus.Labels{"target": apiUrl}).Inc()
+		return nil, &ApiError{Kind: ErrDecode, Err: fmt.Errorf("unable to decode API response: %w", err)}
+	}
+
+	return ret, nil
+}
+
+func parseTime(value string) (parsedTime time.Time, err error) {
+	value = strings.TrimSpace(value)
+	for _, format := range timeFormatList {
+		parsedTime, err = time.Parse(format, value)
+		if err == nil {
+			// normalize to UTC
+			parsedTime = parsedTime.UTC()
+			break
+		}
+	}
+
+	return
+}
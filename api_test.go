@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchApiUrlStatusCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		response imdsTestResponse
+		err      error
+		events   int
+	}{
+		{name: "events", response: imdsTestResponse{status: http.StatusOK, body: imdsTestEventsBody}, events: 1},
+		{name: "no events", response: imdsTestResponse{status: http.StatusOK, body: `{"DocumentIncarnation":1,"Events":[]}`}},
+		{name: "empty body", response: imdsTestResponse{status: http.StatusOK, body: ""}},
+		{name: "no content", response: imdsTestResponse{status: http.StatusNoContent}},
+		{name: "malformed json", response: imdsTestResponse{status: http.StatusOK, body: `{"DocumentIncarnation":1,"Events":[`}, err: ErrDecode},
+		{name: "bad request", response: imdsTestResponse{status: http.StatusBadRequest, body: `{"error":"invalid api-version"}`}, err: ErrHTTPStatus},
+		{name: "server error", response: imdsTestResponse{status: http.StatusInternalServerError}, err: ErrHTTPStatus},
+		{name: "unavailable", response: imdsTestResponse{status: http.StatusServiceUnavailable}, err: ErrHTTPStatus},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestOptions(t, "--api-retry-count=0")
+			server := newImdsTestServer(t, test.response)
+
+			response, err := fetchApiUrl(context.Background(), apiTargets[0].Url)
+			if server.Requests() != 1 {
+				t.Errorf("expected 1 request, got %v", server.Requests())
+			}
+
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("expected error %v, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(response.Events) != test.events {
+				t.Errorf("expected %v events, got %v", test.events, len(response.Events))
+			}
+		})
+	}
+}
+
+func TestFetchApiUrlRetry(t *testing.T) {
+	setupTestOptions(t, "--api-retry-count=3", "--api-retry-delay=1ms")
+	server := newImdsTestServer(t,
+		imdsTestResponse{status: http.StatusInternalServerError},
+		imdsTestResponse{status: http.StatusOK, body: `{"DocumentIncarnation":1,"Events":[`},
+		imdsTestResponse{status: http.StatusOK, body: imdsTestEventsBody},
+	)
+
+	response, err := fetchApiUrl(context.Background(), apiTargets[0].Url)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(response.Events) != 1 {
+		t.Errorf("expected 1 event, got %v", len(response.Events))
+	}
+	if server.Requests() != 3 {
+		t.Errorf("expected 3 requests, got %v", server.Requests())
+	}
+}
+
+func TestFetchApiUrlRetryExhausted(t *testing.T) {
+	setupTestOptions(t, "--api-retry-count=2", "--api-retry-delay=1ms")
+	server := newImdsTestServer(t, imdsTestResponse{status: http.StatusServiceUnavailable})
+
+	_, err := fetchApiUrl(context.Background(), apiTargets[0].Url)
+	if !errors.Is(err, ErrHTTPStatus) {
+		t.Fatalf("expected error %v, got %v", ErrHTTPStatus, err)
+	}
+	if server.Requests() != 3 {
+		t.Errorf("expected 3 requests (1 + 2 retries), got %v", server.Requests())
+	}
+}
+
+func TestFetchApiUrlTimeout(t *testing.T) {
+	setupTestOptions(t, "--api-retry-count=0", "--api-timeout=100ms")
+	newImdsTestServer(t, imdsTestResponse{status: http.StatusOK, body: imdsTestEventsBody, delay: 5 * time.Second})
+
+	startTime := time.Now()
+	_, err := fetchApiUrl(context.Background(), apiTargets[0].Url)
+	if !errors.Is(err, ErrNetwork) {
+		t.Fatalf("expected error %v, got %v", ErrNetwork, err)
+	}
+	if duration := time.Since(startTime); duration > time.Second {
+		t.Errorf("expected timeout after 100ms, took %v", duration)
+	}
+}
+
+func TestFetchApiUrlRetryDeadline(t *testing.T) {
+	// overall deadline: api-timeout * (retry-count + 1) = 1.5s, also bounds the last attempt
+	setupTestOptions(t, "--api-retry-count=2", "--api-retry-delay=200ms", "--api-timeout=500ms")
+	newImdsTestServer(t, imdsTestResponse{status: http.StatusOK, body: imdsTestEventsBody, delay: 5 * time.Second})
+
+	startTime := time.Now()
+	_, err := fetchApiUrl(context.Background(), apiTargets[0].Url)
+	if !errors.Is(err, ErrNetwork) {
+		t.Fatalf("expected error %v, got %v", ErrNetwork, err)
+	}
+	if duration := time.Since(startTime); duration > 1700*time.Millisecond {
+		t.Errorf("expected API call to be bounded by 1.5s, took %v", duration)
+	}
+}
+
+func TestDecodeApiResponseDurationInSeconds(t *testing.T) {
+	body := []byte(`{"DocumentIncarnation":1,"Events":[
+		{"EventId":"with-duration","EventType":"Reboot","DurationInSeconds":300},
+		{"EventId":"zero-duration","EventType":"Reboot","DurationInSeconds":0},
+		{"EventId":"unknown-duration","EventType":"Reboot","DurationInSeconds":-1},
+		{"EventId":"missing-duration","EventType":"Reboot"}
+	]}`)
+
+	response, err := decodeApiResponse(context.Background(), "http://imds.test", body)
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+
+	expected := map[string]int{
+		"with-duration":    300,
+		"zero-duration":    0,
+		"unknown-duration": -1,
+		"missing-duration": -1,
+	}
+	if len(response.Events) != len(expected) {
+		t.Fatalf("expected %v events, got %v", len(expected), len(response.Events))
+	}
+	for _, event := range response.Events {
+		if event.DurationInSeconds != expected[event.EventId] {
+			t.Errorf("event %v: expected DurationInSeconds %v, got %v", event.EventId, expected[event.EventId], event.DurationInSeconds)
+		}
+	}
+}
+
+func TestFetchApiUrlProxy(t *testing.T) {
+	// non-loopback host (loopback hosts are never proxied), only resolvable via test proxy
+	apiUrl := "http://imds.test" + apiDefaultPath
+
+	t.Run("proxy env", func(t *testing.T) {
+		setupTestOptions(t, "--api-retry-count=0")
+		requestCount := len(testProxyRequestList())
+
+		response, err := fetchApiUrl(context.Background(), apiUrl)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(response.Events) != 1 {
+			t.Errorf("expected 1 event, got %v", len(response.Events))
+		}
+
+		requests := testProxyRequestList()
+		if len(requests) != requestCount+1 || requests[len(requests)-1] != apiUrl {
+			t.Errorf("expected request %v via proxy, got %v", apiUrl, requests[requestCount:])
+		}
+	})
+
+	t.Run("api-no-proxy", func(t *testing.T) {
+		setupTestOptions(t, "--api-retry-count=0", "--api-timeout=1s", "--api-no-proxy")
+		requestCount := len(testProxyRequestList())
+
+		if _, err := fetchApiUrl(context.Background(), apiUrl); !errors.Is(err, ErrNetwork) {
+			t.Errorf("expected error %v (without proxy), got %v", ErrNetwork, err)
+		}
+		if requests := testProxyRequestList(); len(requests) != requestCount {
+			t.Errorf("expected no request via proxy, got %v", requests[requestCount:])
+		}
+	})
+}
+
+func TestParseTime(t *testing.T) {
+	expected := time.Date(2022, time.September, 19, 18, 29, 47, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		value    string
+		expected time.Time
+		err      bool
+	}{
+		{name: "RFC1123 (IMDS)", value: "Mon, 19 Sep 2022 18:29:47 GMT", expected: expected},
+		{name: "RFC1123Z", value: "Mon, 19 Sep 2022 20:29:47 +0200", expected: expected},
+		{name: "RFC3339", value: "2022-09-19T18:29:47Z", expected: expected},
+		{name: "RFC3339 with offset", value: "2022-09-19T20:29:47+02:00", expected: expected},
+		{name: "RFC3339Nano", value: "2022-09-19T18:29:47.123456789Z", expected: expected.Add(123456789 * time.Nanosecond)},
+		{name: "RFC822Z", value: "19 Sep 22 18:29 +0000", expected: expected.Truncate(time.Minute)},
+		{name: "RFC850", value: "Monday, 19-Sep-22 18:29:47 GMT", expected: expected},
+		{name: "without zone", value: "2022-09-19T18:29:47", expected: expected},
+		{name: "without zone with fraction", value: "2022-09-19T18:29:47.5", expected: expected.Add(500 * time.Millisecond)},
+		{name: "date and time", value: "2022-09-19 18:29:47", expected: expected},
+		{name: "surrounding whitespace", value: "  Mon, 19 Sep 2022 18:29:47 GMT\n", expected: expected},
+		{name: "empty", value: "", err: true},
+		{name: "invalid", value: "next monday", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsedTime, err := parseTime(test.value)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error for %q, got %v", test.value, parsedTime)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error for %q: %v", test.value, err)
+			}
+			if !parsedTime.Equal(test.expected) || parsedTime.Location() != time.UTC {
+				t.Errorf("expected %v, got %v", test.expected, parsedTime)
+			}
+		})
+	}
+}
+
+// returns first interface with link-local IPv6 address
+func linkLocalTestInterface(t *testing.T) (string, net.IP) {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("unable to list interfaces: %v", err)
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				return iface.Name, ipNet.IP
+			}
+		}
+	}
+
+	t.Skip("no interface with link-local IPv6 address")
+	return "", nil
+}
+
+func TestFetchApiUrlInterface(t *testing.T) {
+	tests := []struct {
+		name  string
+		iface func(t *testing.T) (iface, listenAddr, urlHost string)
+	}{
+		{
+			name: "IPv4 loopback",
+			iface: func(t *testing.T) (string, string, string) {
+				if _, err := net.InterfaceByName("lo"); err != nil {
+					t.Skip("no loopback interface \"lo\"")
+				}
+				return "lo", "127.0.0.1:0", "127.0.0.1"
+			},
+		},
+		{
+			name: "IPv6 link-local with zone",
+			iface: func(t *testing.T) (string, string, string) {
+				iface, ip := linkLocalTestInterface(t)
+				return iface, "[" + ip.String() + "%" + iface + "]:0", "[" + ip.String() + "%25" + iface + "]"
+			},
+		},
+		{
+			name: "IPv6 link-local without zone",
+			iface: func(t *testing.T) (string, string, string) {
+				iface, ip := linkLocalTestInterface(t)
+				return iface, "[" + ip.String() + "%" + iface + "]:0", "[" + ip.String() + "]"
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			iface, listenAddr, urlHost := test.iface(t)
+			listener, err := net.Listen("tcp", listenAddr)
+			if err != nil {
+				t.Skipf("unable to listen on %v: %v", listenAddr, err)
+			}
+
+			remoteAddrs := make(chan string, 1)
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				remoteAddrs <- r.RemoteAddr
+				_, _ = w.Write([]byte(imdsTestEventsBody))
+			}))
+			_ = server.Listener.Close()
+			server.Listener = listener
+			server.Start()
+			defer server.Close()
+
+			// API URL with scoped address is validated and dialed from address of --api-interface
+			// (without HTTP_PROXY of test binary, only loopback addresses are never proxied)
+			_, port, _ := net.SplitHostPort(listener.Addr().String())
+			setupTestOptions(t, "--api-url=http://"+urlHost+":"+port+apiDefaultPath, "--api-interface="+iface, "--api-no-proxy", "--api-retry-count=0")
+
+			response, err := fetchApiUrl(context.Background(), opts.ApiUrl[0])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(response.Events) != 1 {
+				t.Errorf("expected 1 event, got %v", len(response.Events))
+			}
+
+			// connection is bound to interface address (listener address)
+			listenHost, _, _ := net.SplitHostPort(listenAddr)
+			select {
+			case remoteAddr := <-remoteAddrs:
+				if localHost, _, _ := net.SplitHostPort(remoteAddr); localHost != listenHost {
+					t.Errorf("expected connection from %v, got %v", listenHost, localHost)
+				}
+			default:
+				t.Error("API request didn't reach test server")
+			}
+		})
+	}
+
+	t.Run("unknown interface", func(t *testing.T) {
+		setupTestOptions(t)
+		dialContext := apiInterfaceDialContext("missing0")
+		if _, err := dialContext(context.Background(), "tcp", "127.0.0.1:80"); err == nil {
+			t.Errorf("expected error for unknown interface, got %v", err)
+		}
+	})
+}
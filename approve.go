@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type AzureScheduledEventApproval struct {
+	StartRequests []AzureScheduledEventStartRequest `json:"StartRequests"`
+}
+
+type AzureScheduledEventStartRequest struct {
+	EventId string `json:"EventId"`
+}
+
+// approves event if matching auto approval options, every EventId is only approved once per document incarnation
+func autoApproveEvent(ctx context.Context, target *ApiTarget, incarnation int, event AzureScheduledEvent) {
+	if !eventAutoApprove(event) {
+		return
+	}
+
+	// approvals of previous incarnations are forgotten (event might be rescheduled)
+	if target.approvedEventIds == nil || target.approvedIncarnation != incarnation {
+		target.approvedEventIds = map[string]bool{}
+		target.dryRunEventIds = map[string]bool{}
+		target.approveDueTimes = map[string]time.Time{}
+		target.approvedIncarnation = incarnation
+	}
+	if target.approvedEventIds[event.EventId] {
+		return
+	}
+
+	eventLogger := scrapeLogger(ctx).WithFields(log.Fields{
+		"url":       target.Url,
+		"eventId":   event.EventId,
+		"eventType": event.EventType,
+	})
+
+	// logged once per EventId like approvals, tracked separately so events are approved if dry run is disabled by reload
+	if opts.ApproveDryRun {
+		if !target.dryRunEventIds[event.EventId] {
+			target.dryRunEventIds[event.EventId] = true
+			eventLogger.Infof("dry run: would approve event \"%v\" of type \"%v\"", event.EventId, event.EventType)
+			scheduledEventApproveDryRun.With(prometheus.Labels{"target": target.Url}).Inc()
+		}
+		return
+	}
+
+	// --dev.api-mock-file: there is no Azure API to send approval to
+	if opts.ApiMockFile != "" {
+		eventLogger.Infof("mock file: not approving event \"%v\" of type \"%v\"", event.EventId, event.EventType)
+		return
+	}
+
+	// --action-throttle, --action-max-concurrent: postponed to later scrape
+	dueTime := target.approveDueTimes[event.EventId]
+	due := actionDue(&dueTime)
+	target.approveDueTimes[event.EventId] = dueTime
+	if !due {
+		eventLogger.Debugf("postponing approval of event \"%v\" until %v (--action-throttle)", event.EventId, dueTime.Format(time.RFC3339))
+		return
+	}
+	release, ok := tryAcquireAction()
+	if !ok {
+		eventLogger.Debugf("postponing approval of event \"%v\", max concurrent actions running", event.EventId)
+		return
+	}
+
+	eventLogger.Infof("approving event \"%v\" of type \"%v\"", event.EventId, event.EventType)
+	err := approveEvent(ctx, target.Url, event.EventId)
+	release()
+	countAction(ctx, "approve", err)
+	if err != nil {
+		// retried next scrape
+		eventLogger.Errorf("failed to approve event \"%v\": %v", event.EventId, err)
+		return
+	}
+	target.approvedEventIds[event.EventId] = true
+}
+
+// checks if event should be approved automatically (event type and status must match if both are set)
+func eventAutoApprove(event AzureScheduledEvent) bool {
+	if len(opts.AutoApproveEventTypes) == 0 && len(opts.AutoApproveStatuses) == 0 {
+		return false
+	}
+
+	// only scheduled events can be started
+	if !strings.EqualFold(event.EventStatus, "Scheduled") {
+		return false
+	}
+
+	if len(opts.AutoApproveEventTypes) > 0 && !containsFold(opts.AutoApproveEventTypes, event.EventType) {
+		return false
+	}
+
+	if len(opts.AutoApproveStatuses) > 0 && !containsFold(opts.AutoApproveStatuses, event.EventStatus) {
+		return false
+	}
+
+	return true
+}
+
+// checks if list contains value (case insensitive)
+func containsFold(list []string, value string) bool {
+	for _, val := range list {
+		if strings.EqualFold(val, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// approves (starts) event via Azure ScheduledEvents API
+func approveEvent(ctx context.Context, apiUrl string, eventId string) error {
+	ctx, cancel := context.WithTimeout(ctx, opts.ApiTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(AzureScheduledEventApproval{
+		StartRequests: []AzureScheduledEventStartRequest{{EventId: eventId}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", apiUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := setApiRequestHeaders(req); err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, apiErrorBodyLimit))
+		return fmt.Errorf("unexpected status %v from IMDS: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
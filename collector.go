@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+	"time"
+)
+
+// ScheduledEventsCollector wraps the Azure ScheduledEvents metrics and refreshes
+// them at scrape time if the cached data is older than the cache ttl
+type ScheduledEventsCollector struct {
+	ctx        context.Context
+	collectors []prometheus.Collector
+}
+
+var (
+	// unix nano timestamp of last probe run (successful or not)
+	lastProbeTime int64
+)
+
+func NewScheduledEventsCollector(ctx context.Context, collectors ...prometheus.Collector) *ScheduledEventsCollector {
+	return &ScheduledEventsCollector{
+		ctx:        ctx,
+		collectors: collectors,
+	}
+}
+
+func (c *ScheduledEventsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors {
+		collector.Describe(ch)
+	}
+}
+
+func (c *ScheduledEventsCollector) Collect(ch chan<- prometheus.Metric) {
+	refreshStaleMetrics(c.ctx)
+
+	// wait for running metrics update
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+
+	for _, collector := range c.collectors {
+		collector.Collect(ch)
+	}
+}
+
+// runs probe if cached data is older than cache ttl (onscrape mode only, background mode never calls the API
+// from scrapes so API load and side effects like approvals and hooks are independent of Prometheus scrapes)
+func refreshStaleMetrics(ctx context.Context) {
+	if opts.CollectionMode != "onscrape" {
+		return
+	}
+
+	if time.Since(time.Unix(0, atomic.LoadInt64(&lastProbeTime))) >= opts.CacheTtl {
+		runProbeCollect(ctx)
+	}
+}
+
+// DataAgeCollector exports the age of the served data and of the document incarnation per target, calculated at scrape time
+type DataAgeCollector struct {
+	desc               *prometheus.Desc
+	incarnationAgeDesc *prometheus.Desc
+}
+
+func NewDataAgeCollector() *DataAgeCollector {
+	return &DataAgeCollector{
+		desc: prometheus.NewDesc(
+			"azure_scheduledevents_data_age_seconds",
+			"Azure ScheduledEvents seconds since last successful scrape (since startup if no scrape was successful yet)",
+			[]string{"target"},
+			nil,
+		),
+		incarnationAgeDesc: prometheus.NewDesc(
+			"azure_scheduledevent_document_incarnation_age_seconds",
+			"Azure ScheduledEvent seconds since last document incarnation change (since first successful scrape if unchanged)",
+			[]string{"target"},
+			nil,
+		),
+	}
+}
+
+func (c *DataAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+	ch <- c.incarnationAgeDesc
+}
+
+func (c *DataAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	collectionLock.RLock()
+	defer collectionLock.RUnlock()
+
+	for _, target := range apiTargets {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(target.lastSuccessTime).Seconds(), target.Url)
+
+		if target.documentIncarnationSeen {
+			ch <- prometheus.MustNewConstMetric(c.incarnationAgeDesc, prometheus.GaugeValue, time.Since(target.documentIncarnationChangeTime).Seconds(), target.Url)
+		}
+	}
+}
@@ -10,25 +10,104 @@ type (
 	Opts struct {
 		// logger
 		Logger struct {
-			Debug   bool `           long:"debug"        env:"DEBUG"    description:"debug mode"`
-			Verbose bool `short:"v"  long:"verbose"      env:"VERBOSE"  description:"verbose mode"`
-			LogJson bool `           long:"log.json"     env:"LOG_JSON" description:"Switch log output to json format"`
+			Debug     bool   `           long:"debug"        env:"DEBUG"    description:"debug mode"`
+			Verbose   bool   `short:"v"  long:"verbose"      env:"VERBOSE"  description:"verbose mode"`
+			LogJson   bool   `           long:"log.json"     env:"LOG_JSON"   description:"Switch log output to json format (same as --log.format=json)"`
+			LogFormat string `           long:"log.format"   env:"LOG_FORMAT" description:"Log output format" default:"text" choice:"text" choice:"json"`
+			LogLevel  string `           long:"log.level"    env:"LOG_LEVEL"  description:"Log level (verbose is an alias for debug)" default:"info" choice:"error" choice:"warn" choice:"info" choice:"verbose" choice:"debug"`
 		}
 
+		// config file
+		ConfigFile  string `long:"config"       env:"CONFIG_FILE" description:"Path to yaml config file (keys are the long option names, command line and env vars take precedence)"`
+		PrintConfig bool   `long:"print-config"                   description:"Print resolved config (yaml, secrets redacted) and exit" json:"-"`
+		Version     bool   `long:"version"                        description:"Print version and exit" json:"-"`
+
 		// general options
-		ServerBind string        `long:"bind"                env:"SERVER_BIND"   description:"Server address"                default:":8080"`
-		ScrapeTime time.Duration `long:"scrape-time"         env:"SCRAPE_TIME"   description:"Scrape time in seconds"        default:"1m"`
+		ServerBind            string        `long:"bind"                env:"SERVER_BIND"   description:"Server address"                default:":8080"`
+		ServerShutdownTimeout time.Duration `long:"shutdown-timeout"    env:"SHUTDOWN_TIMEOUT" description:"Grace period for draining in-flight requests on shutdown" default:"10s"`
+		TlsCertFile           string        `long:"tls.cert"            env:"TLS_CERT"      description:"TLS certificate file for serving metrics via https"`
+		TlsKeyFile            string        `long:"tls.key"             env:"TLS_KEY"       description:"TLS key file for serving metrics via https"`
+		BasicAuthUsername     string        `long:"basicauth.username"  env:"BASICAUTH_USERNAME" description:"Basic auth username for metrics endpoint"`
+		BasicAuthPassword     string        `long:"basicauth.password"  env:"BASICAUTH_PASSWORD" description:"Basic auth password for metrics endpoint" json:"-"`
+		ScrapeTime            time.Duration `long:"scrape-time"         env:"SCRAPE_TIME"   description:"Scrape time in seconds"        default:"1m"`
+		CacheTtl              time.Duration `long:"cache-ttl"           env:"CACHE_TTL"     description:"Collection mode onscrape: refresh metrics at Prometheus scrape if cached data is older than ttl (0 to refresh every scrape)" default:"10s"`
+		CollectionMode        string        `long:"collection-mode"     env:"COLLECTION_MODE" description:"Metrics collection mode (background: collect every scrape-time, onscrape: collect only at Prometheus scrape)" default:"background" choice:"background" choice:"onscrape"`
+		EnablePprof           bool          `long:"server.pprof"        env:"SERVER_PPROF"  description:"Enable pprof endpoints on /debug/pprof/ (protected by basic auth if set)"`
+		EnableInflux          bool          `long:"server.influx"       env:"SERVER_INFLUX" description:"Enable /influx endpoint serving events in InfluxDB line protocol (protected by basic auth if set)"`
+
+		ScrapeTimeout   time.Duration `long:"scrape-timeout"    env:"SCRAPE_TIMEOUT"    description:"Timeout for API calls (including retries) of all targets per scrape, remaining calls are cancelled (0 to disable)" default:"0"`
+		NoStartupJitter bool          `long:"no-startup-jitter" env:"NO_STARTUP_JITTER" description:"Don't delay first scrape by random time (up to scrape-time) after startup"`
 
 		// Api options
-		ApiUrl            string        `long:"api-url"             env:"API_URL"       description:"Azure ScheduledEvents API URL" default:"http://169.254.169.254/metadata/scheduledevents?api-version=2017-11-01"`
-		ApiTimeout        time.Duration `long:"api-timeout"         env:"API_TIMEOUT"   description:"Azure API timeout (seconds)"   default:"30s"`
-		ApiErrorThreshold int           `long:"api-error-threshold" env:"API_ERROR_THRESHOLD"   description:"Azure API error threshold (after which app will panic)"   default:"0"`
+		ApiUrl             []string      `long:"api-url"             env:"API_URL"       description:"Azure ScheduledEvents API URL (multiple targets possible, space separated for env)" default:"http://169.254.169.254/metadata/scheduledevents?api-version=2017-11-01" env-delim:" "`
+		ApiVersion         string        `long:"api-version"         env:"API_VERSION"   description:"Azure ScheduledEvents API version (overrides api-version of API URL, empty to disable)" default:"2020-07-01"`
+		ApiNoProxy         bool          `long:"api-no-proxy"        env:"API_NO_PROXY"  description:"Don't use proxy (HTTP_PROXY/NO_PROXY env) for Azure API requests"`
+		ApiClientCertFile  string        `long:"api-tls.cert"        env:"API_TLS_CERT"  description:"TLS client certificate file for Azure API requests (eg. mTLS metadata proxy)"`
+		ApiClientKeyFile   string        `long:"api-tls.key"         env:"API_TLS_KEY"   description:"TLS client key file for Azure API requests"`
+		ApiCACertFile      string        `long:"api-tls.ca"          env:"API_TLS_CA"    description:"CA file for verification of Azure API (eg. metadata proxy) certificate"`
+		ApiUnixSocket      string        `long:"api-unix-socket"     env:"API_UNIX_SOCKET" description:"Connect to Azure API via unix socket (eg. metadata proxy), API URL is still used for requests"`
+		ApiMaxIdleConns    int           `long:"api-max-idle-conns"     env:"API_MAX_IDLE_CONNS"     description:"Max idle (keep-alive) connections to Azure API" default:"100"`
+		ApiIdleConnTimeout time.Duration `long:"api-idle-conn-timeout"  env:"API_IDLE_CONN_TIMEOUT"  description:"Timeout for idle (keep-alive) connections to Azure API" default:"90s"`
+		UserAgent          string        `long:"api-useragent"       env:"API_USERAGENT" description:"User-Agent header for Azure API requests (default: azure-scheduledevents-exporter/<version>)"`
+		ApiTimeout         time.Duration `long:"api-timeout"         env:"API_TIMEOUT"   description:"Azure API timeout (seconds)"   default:"30s"`
+		ApiErrorThreshold  int           `long:"api-error-threshold" env:"API_ERROR_THRESHOLD"   description:"Azure API error threshold (after which app will panic)"   default:"0"`
+		ApiErrorWindow     time.Duration `long:"api-error-window"    env:"API_ERROR_WINDOW"      description:"Evaluate error threshold against failed API calls within this window instead of consecutive failures (0 to disable)" default:"0"`
+		ApiErrorBehavior   string        `long:"api-error-behavior"  env:"API_ERROR_BEHAVIOR"    description:"Behavior when API error threshold is reached (panic: exit app, continue: log and keep serving metrics)" default:"panic" choice:"panic" choice:"continue"`
+		ApiRetryCount      int           `long:"api-retry-count"     env:"API_RETRY_COUNT"       description:"Azure API retry count for failed requests"               default:"3"`
+		ApiRetryDelay      time.Duration `long:"api-retry-delay"     env:"API_RETRY_DELAY"       description:"Azure API initial retry delay (exponential backoff)"   default:"1s"`
+		MinFetchInterval   time.Duration `long:"api-min-fetch-interval" env:"API_MIN_FETCH_INTERVAL" description:"Minimum interval between Azure API calls per target, last data is served in between (0 to disable)" default:"0"`
+
+		ApiHost            string            `long:"api-host" env:"API_HOST" description:"Scheme and host for default Azure API path (eg. http://127.0.0.1:8080 for mock or proxy; ignored if --api-url is set)"`
+		RequireAzure       bool              `long:"require-azure" env:"REQUIRE_AZURE" description:"Exit at startup if Azure Instance Metadata Service (host of first API URL) is not reachable"`
+		ApiInterface       string            `long:"api-interface" env:"API_INTERFACE" description:"Bind Azure API connections to address of this network interface (eg. eth0, also used as zone of link-local IPv6 API addresses)"`
+		ApiBearerTokenFile string            `long:"api-bearer-token-file" env:"API_BEARER_TOKEN_FILE" description:"File containing bearer token for Authorization header of Azure API requests (eg. authenticated metadata proxy; re-read if changed)"`
+		ApiHeaders         map[string]string `long:"api-header" env:"API_HEADER" description:"Additional header for Azure API requests (name:value, multiple possible, space separated for env; overrides Metadata: true)" env-delim:" " json:"-"`
+
+		// development only
+		ApiMockFile string `long:"dev.api-mock-file" env:"DEV_API_MOCK_FILE" description:"DEVELOPMENT ONLY: read Azure API response (json) from file instead of calling the Azure API, approvals are not sent"`
 
 		Notification            []string `long:"notification"                 env:"NOTIFICATION"              description:"Shoutrrr url for notifications (https://containrrr.github.io/shoutrrr/)" env-delim:" "  json:"-"`
 		NotificationMsgTemplate string   `long:"notification.messagetemplate" env:"NOTIFICATION_MESSAGE_TEMPLATE"  description:"Notification template" default:"%v"`
 
+		// event filter
+		EventTypeInclude []string `long:"event-type-include" env:"EVENT_TYPE_INCLUDE" description:"Only export events of these types (eg. Freeze, Reboot; takes precedence over exclude)" env-delim:" "`
+		EventTypeExclude []string `long:"event-type-exclude" env:"EVENT_TYPE_EXCLUDE" description:"Do not export events of these types (eg. Terminate, Preempt)" env-delim:" "`
+		OnMissingField   string   `long:"on-missing-field"   env:"ON_MISSING_FIELD"   description:"Handling of events with missing EventType, ResourceType or EventStatus (placeholder: use \"unknown\", skip: skip event; events without EventId are always skipped)" default:"placeholder" choice:"placeholder" choice:"skip"`
+		ResourceNameMode string   `long:"resource-name-mode" env:"RESOURCE_NAME_MODE" description:"Normalization of resource names (asis: unchanged, short: last segment of resource id without domain, fqdn-strip: without domain)" default:"asis" choice:"asis" choice:"short" choice:"fqdn-strip"`
+
+		SelfName       string        `long:"self-name"       env:"SELF_NAME"       description:"Name of this VM for azure_scheduledevent_affects_self (default: compute name of IMDS instance metadata)"`
+		EventRetention time.Duration `long:"event-retention" env:"EVENT_RETENTION" description:"Keep metrics of events disappeared from API response for this duration (marked via azure_scheduledevent_event_stale; 0 to disable)" default:"0"`
+
+		// event approval
+		AutoApproveEventTypes []string `long:"auto-approve-event-type" env:"AUTO_APPROVE_EVENT_TYPE" description:"Automatically approve (start) scheduled events of these types (eg. Freeze, Reboot)" env-delim:" "`
+		AutoApproveStatuses   []string `long:"auto-approve-event-status" env:"AUTO_APPROVE_EVENT_STATUS" description:"Automatically approve (start) events with these statuses (only Scheduled is supported; combined with event types if both are set)" env-delim:" "`
+		ApproveDryRun         bool     `long:"approve-dry-run"         env:"APPROVE_DRY_RUN"         description:"Only log events which would be approved, don't send approval to Azure API"`
+
+		// event hook
+		OnEventCommand string        `long:"on-event.command" env:"ON_EVENT_COMMAND" description:"Command (executed via /bin/sh) to run once per new event, event fields are passed as AZURE_SCHEDULEDEVENT_* env vars"`
+		OnEventTimeout time.Duration `long:"on-event.timeout" env:"ON_EVENT_TIMEOUT" description:"Timeout for on-event command" default:"1m"`
+
+		// webhook
+		WebhookUrl     string        `long:"webhook.url"     env:"WEBHOOK_URL"     description:"URL to POST new events (json) to, once per event" json:"-"`
+		WebhookTimeout time.Duration `long:"webhook.timeout" env:"WEBHOOK_TIMEOUT" description:"Timeout for webhook requests" default:"10s"`
+
+		// kubernetes
+		KubeCordon bool   `long:"kube.cordon"    env:"KUBE_CORDON" description:"Cordon Kubernetes node while disruptive events (Reboot, Redeploy, Terminate) affecting this VM are scheduled (requires in-cluster service account)"`
+		NodeName   string `long:"kube.node-name" env:"NODE_NAME"   description:"Kubernetes node name for --kube.cordon (eg. from spec.nodeName via downward API)"`
+
+		// action throttle
+		ActionThrottle      time.Duration `long:"action-throttle"       env:"ACTION_THROTTLE"       description:"Random delay (up to this duration) before side-effecting actions (approve, cordon, on-event command, webhook) to spread actions of many instances; approve and cordon are postponed to later scrapes (0 to disable)" default:"0"`
+		ActionMaxConcurrent int           `long:"action-max-concurrent" env:"ACTION_MAX_CONCURRENT" description:"Max concurrent side-effecting actions per process (0 for unlimited)" default:"0"`
+
 		// metrics
-		MetricsRequestStats bool `long:"metrics-requeststats" env:"METRICS_REQUESTSTATS" description:"Enable request stats metrics"`
+		MetricsPath         string `long:"metrics-path"         env:"METRICS_PATH"         description:"Path for metrics endpoint" default:"/metrics"`
+		MetricsRequestStats bool   `long:"metrics-requeststats" env:"METRICS_REQUESTSTATS" description:"Enable request stats metrics"`
+		NotBeforeAsLabel    bool   `long:"metrics-notbefore-label" env:"METRICS_NOTBEFORE_LABEL" description:"Add NotBefore as label to azure_scheduledevent_event metric (causes series churn on reschedules)"`
+		EventValueMode      string `long:"metrics-event-value"     env:"METRICS_EVENT_VALUE"     description:"Value of azure_scheduledevent_event metric (notbefore: NotBefore timestamp, 1 if not set, NaN if unparseable; presence: always 1)" default:"notbefore" choice:"notbefore" choice:"presence"`
+
+		LabelSet         string `long:"metrics-labelset" env:"METRICS_LABELSET" description:"Labels of azure_scheduledevent_event metric (minimal: eventID, eventType; standard: per resource with status and source; full: standard plus description and duration)" default:"standard" choice:"minimal" choice:"standard" choice:"full"`
+		MetricsNamespace string `long:"metrics-namespace" env:"METRICS_NAMESPACE" description:"Namespace (prefix) for all exporter metrics, eg. myorg results in myorg_azure_scheduledevent_event"`
+		MetricsSubsystem string `long:"metrics-subsystem" env:"METRICS_SUBSYSTEM" description:"Subsystem (prefix after namespace) for all exporter metrics"`
 	}
 )
 
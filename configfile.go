@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	log "github.com/sirupsen/logrus"
+	"github.com/webdevops/azure-scheduledevents-exporter/config"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// prefix for env vars, prefixed env vars take precedence over unprefixed ones
+	envPrefix = "AZURE_SCHEDULEDEVENTS_"
+)
+
+// parses command line arguments and env vars (and config file if set) into new options
+func parseOptions(args []string) (*flags.Parser, *config.Opts, error) {
+	parsedOpts := &config.Opts{}
+	parser := flags.NewParser(parsedOpts, flags.Default)
+	applyEnvPrefix(parser)
+	if _, err := parser.ParseArgs(args); err != nil {
+		return parser, parsedOpts, err
+	}
+
+	if parsedOpts.ConfigFile != "" {
+		configArgs, err := parseConfigFile(parser, parsedOpts.ConfigFile)
+		if err != nil {
+			return parser, parsedOpts, err
+		}
+
+		// reparse with config file values, command line arguments are appended and take precedence
+		parsedOpts = &config.Opts{}
+		parser = flags.NewParser(parsedOpts, flags.Default)
+		applyEnvPrefix(parser)
+		if _, err := parser.ParseArgs(append(configArgs, args...)); err != nil {
+			return parser, parsedOpts, err
+		}
+	}
+
+	applyApiHost(parser, parsedOpts)
+	return parser, parsedOpts, nil
+}
+
+// --api-host: replaces default API URL with same path on host, explicitly set --api-url takes precedence
+func applyApiHost(parser *flags.Parser, o *config.Opts) {
+	if o.ApiHost == "" {
+		return
+	}
+
+	if optionSetExplicitly(parser.FindOptionByLongName("api-url")) {
+		log.Warnf("ignoring --api-host \"%v\", --api-url is set", o.ApiHost)
+		return
+	}
+
+	o.ApiUrl = []string{strings.TrimSuffix(o.ApiHost, "/") + apiDefaultPath}
+}
+
+// parses yaml config file (keys are the long option names) into command line arguments,
+// options already set via command line or env vars are skipped as they take precedence
+func parseConfigFile(parser *flags.Parser, path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file \"%v\": %w", path, err)
+	}
+
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("unable to parse config file \"%v\": %w", path, err)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := []string{}
+	for _, name := range names {
+		option := parser.FindOptionByLongName(name)
+		if option == nil {
+			log.Warnf("ignoring unknown key \"%v\" in config file \"%v\"", name, path)
+			continue
+		}
+
+		if optionSetExplicitly(option) {
+			log.Debugf("ignoring key \"%v\" in config file \"%v\", option is set via command line or env", name, path)
+			continue
+		}
+
+		switch value := values[name].(type) {
+		case nil:
+			continue
+		case bool:
+			if value {
+				args = append(args, "--"+name)
+			}
+		case []interface{}:
+			for _, item := range value {
+				args = append(args, fmt.Sprintf("--%s=%v", name, item))
+			}
+		case map[string]interface{}:
+			for key, item := range value {
+				args = append(args, fmt.Sprintf("--%s=%s:%v", name, key, item))
+			}
+		default:
+			args = append(args, fmt.Sprintf("--%s=%v", name, value))
+		}
+	}
+
+	return args, nil
+}
+
+// reads options from prefixed env vars (eg. AZURE_SCHEDULEDEVENTS_SCRAPE_TIME instead of SCRAPE_TIME) if set,
+// only the parser is changed, process env (eg. passed to --on-event.command) is kept unchanged
+func applyEnvPrefix(parser *flags.Parser) {
+	eachOption(parser, func(option *flags.Option) {
+		if option.EnvDefaultKey == "" {
+			return
+		}
+
+		// groups don't use env namespaces, key of option is the env var name
+		if _, exists := os.LookupEnv(envPrefix + option.EnvKeyWithNamespace()); exists {
+			option.EnvDefaultKey = envPrefix + option.EnvDefaultKey
+		}
+	})
+}
+
+// calls callback for every option of parser (including sub groups)
+func eachOption(parser *flags.Parser, callback func(option *flags.Option)) {
+	var walkGroup func(group *flags.Group)
+	walkGroup = func(group *flags.Group) {
+		for _, option := range group.Options() {
+			callback(option)
+		}
+
+		for _, subGroup := range group.Groups() {
+			walkGroup(subGroup)
+		}
+	}
+	walkGroup(parser.Group)
+}
+
+// checks if option was set via command line or env var (and not by default value)
+func optionSetExplicitly(option *flags.Option) bool {
+	if option.IsSet() && !option.IsSetDefault() {
+		return true
+	}
+
+	if envKey := option.EnvKeyWithNamespace(); envKey != "" {
+		if _, exists := os.LookupEnv(envKey); exists {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prints resolved options as yaml config file (keys are the long option names), secrets are redacted
+func printConfig(parser *flags.Parser) error {
+	values := map[string]interface{}{}
+
+	eachOption(parser, func(option *flags.Option) {
+		switch option.LongName {
+		case "", "help", "config", "print-config", "version":
+			return
+		}
+
+		value := option.Value()
+		if duration, ok := value.(time.Duration); ok {
+			value = duration.String()
+		}
+
+		// options excluded from json dump are secrets
+		if option.Field().Tag.Get("json") == "-" && !reflect.ValueOf(value).IsZero() {
+			value = "<redacted>"
+		}
+
+		values[option.LongName] = value
+	})
+
+	content, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(content)
+	return err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseOptionsEnvPrefix(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(configFile, []byte("scrape-time: 3m\ncache-ttl: 3m\n"), 0600); err != nil {
+		t.Fatalf("unable to write config file: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		scrapeTime time.Duration
+		cacheTtl   time.Duration
+	}{
+		{name: "env", scrapeTime: 2 * time.Minute, cacheTtl: 10 * time.Second},
+		// env vars take precedence over config file
+		{name: "config file", args: []string{"--config=" + configFile}, scrapeTime: 2 * time.Minute, cacheTtl: 3 * time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SCRAPE_TIME", "1m")
+			t.Setenv(envPrefix+"SCRAPE_TIME", "2m")
+
+			_, parsedOpts, err := parseOptions(test.args)
+			if err != nil {
+				t.Fatalf("unable to parse options: %v", err)
+			}
+			if parsedOpts.ScrapeTime != test.scrapeTime {
+				t.Errorf("expected prefixed env var to take precedence, scrape time %v, got %v", test.scrapeTime, parsedOpts.ScrapeTime)
+			}
+			if parsedOpts.CacheTtl != test.cacheTtl {
+				t.Errorf("expected cache ttl %v, got %v", test.cacheTtl, parsedOpts.CacheTtl)
+			}
+
+			// process env is passed to --on-event.command and must not be changed
+			if value := os.Getenv("SCRAPE_TIME"); value != "1m" {
+				t.Errorf("expected env var SCRAPE_TIME to be unchanged, got %q", value)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// runs on-event command for new event
+func runEventCommand(ctx context.Context, target *ApiTarget, event AzureScheduledEvent) {
+	if opts.OnEventCommand == "" {
+		return
+	}
+
+	eventLogger := scrapeLogger(ctx).WithFields(log.Fields{
+		"url":       target.Url,
+		"eventId":   event.EventId,
+		"eventType": event.EventType,
+	})
+
+	eventLogger.Infof("running on-event command for event \"%v\" of type \"%v\"", event.EventId, event.EventType)
+
+	// command runs async, collection must not be blocked
+	go func() {
+		release, err := acquireAction(ctx)
+		if err != nil {
+			eventLogger.Debugf("on-event command for event \"%v\" cancelled: %v", event.EventId, err)
+			return
+		}
+		defer release()
+
+		cmdCtx, cancel := context.WithTimeout(ctx, opts.OnEventTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(cmdCtx, "/bin/sh", "-c", opts.OnEventCommand)
+		cmd.Env = append(
+			os.Environ(),
+			fmt.Sprintf("AZURE_SCHEDULEDEVENT_TARGET=%s", target.Url),
+			fmt.Sprintf("AZURE_SCHEDULEDEVENT_EVENT_ID=%s", event.EventId),
+			fmt.Sprintf("AZURE_SCHEDULEDEVENT_EVENT_TYPE=%s", event.EventType),
+			fmt.Sprintf("AZURE_SCHEDULEDEVENT_EVENT_STATUS=%s", event.EventStatus),
+			fmt.Sprintf("AZURE_SCHEDULEDEVENT_RESOURCE_TYPE=%s", event.ResourceType),
+			fmt.Sprintf("AZURE_SCHEDULEDEVENT_RESOURCES=%s", strings.Join(event.Resources, " ")),
+			fmt.Sprintf("AZURE_SCHEDULEDEVENT_NOT_BEFORE=%s", event.NotBefore),
+		)
+
+		output, err := cmd.CombinedOutput()
+		countAction(ctx, "command", err)
+		if cmdCtx.Err() == context.DeadlineExceeded {
+			eventLogger.Errorf("on-event command for event \"%v\" timed out after %v", event.EventId, opts.OnEventTimeout)
+		} else if err != nil {
+			eventLogger.Errorf("on-event command for event \"%v\" failed: %v: %s", event.EventId, err, strings.TrimSpace(string(output)))
+		} else {
+			eventLogger.Debugf("on-event command for event \"%v\" finished: %s", event.EventId, strings.TrimSpace(string(output)))
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// events of IMDS fixtures
+	imdsTestEventsBody = `{"DocumentIncarnation":2,"Events":[{"EventId":"602d9444-d2cd-49c7-8624-8643e7171297","EventType":"Reboot","ResourceType":"VirtualMachine","Resources":["FrontEnd_IN_0"],"EventStatus":"Scheduled","NotBefore":"Mon, 19 Sep 2022 18:29:47 GMT","DurationInSeconds":300}]}`
+)
+
+type (
+	// response of IMDS fixture, delay is applied before status and body are sent
+	imdsTestResponse struct {
+		status int
+		body   string
+		delay  time.Duration
+	}
+
+	// IMDS test server, responses are served in order (last one is repeated)
+	imdsTestServer struct {
+		*httptest.Server
+
+		lock      sync.Mutex
+		responses []imdsTestResponse
+		requests  int
+	}
+)
+
+// starts IMDS test server and points --api-url (and API target) at it, server is closed after test
+func newImdsTestServer(t *testing.T, responses ...imdsTestResponse) *imdsTestServer {
+	t.Helper()
+	if len(responses) == 0 {
+		responses = []imdsTestResponse{{status: http.StatusOK, body: imdsTestEventsBody}}
+	}
+
+	server := &imdsTestServer{responses: responses}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	t.Cleanup(server.Close)
+
+	opts.ApiUrl = []string{server.URL + apiDefaultPath}
+	apiTargets = []*ApiTarget{{Url: opts.ApiUrl[0], lastSuccessTime: time.Now()}}
+	return server
+}
+
+func (s *imdsTestServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	response := s.responses[len(s.responses)-1]
+	if s.requests < len(s.responses) {
+		response = s.responses[s.requests]
+	}
+	s.requests++
+	s.lock.Unlock()
+
+	if response.delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(response.delay):
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.status)
+	_, _ = w.Write([]byte(response.body))
+}
+
+// returns number of received requests
+func (s *imdsTestServer) Requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// measurement of InfluxDB line protocol output (--server.influx)
+	influxMeasurement = "azure_scheduledevent"
+)
+
+var (
+	// escaping of measurement, tag keys and tag values in InfluxDB line protocol
+	influxTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// renders azure_scheduledevent_event series in InfluxDB line protocol, labels are exported as tags,
+// metric value and expected impact duration as fields
+func handleInflux(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		refreshStaleMetrics(ctx)
+
+		metricsLock.RLock()
+		eventSeries := collectSeries(scheduledEvent)
+		durationSeries := collectSeries(scheduledEventDuration)
+		metricsLock.RUnlock()
+
+		// expected impact duration by target and eventID
+		durations := map[[2]string]float64{}
+		for _, metric := range durationSeries {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			durations[[2]string{labels["target"], labels["eventID"]}] = metric.GetGauge().GetValue()
+		}
+
+		timestamp := time.Now().UnixNano()
+		lines := []string{}
+		for _, metric := range eventSeries {
+			line := influxMeasurement
+			labels := map[string]string{}
+			// labels are sorted by name
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+
+				// empty tag values are not allowed, duration label (--metrics-labelset=full) is exported as field
+				if label.GetValue() != "" && label.GetName() != "duration" {
+					line += "," + influxTagEscaper.Replace(label.GetName()) + "=" + influxTagEscaper.Replace(label.GetValue())
+				}
+			}
+
+			// NaN (unparseable NotBefore) is not supported by line protocol, exported as parse_ok=false
+			value := metric.GetGauge().GetValue()
+			if math.IsNaN(value) {
+				line += " parse_ok=false"
+			} else {
+				line += " value=" + strconv.FormatFloat(value, 'f', -1, 64) + ",parse_ok=true"
+			}
+			if duration, ok := durations[[2]string{labels["target"], labels["eventID"]}]; ok {
+				line += fmt.Sprintf(",duration=%di", int64(duration))
+			}
+			lines = append(lines, fmt.Sprintf("%s %d", line, timestamp))
+		}
+		sort.Strings(lines)
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range lines {
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				log.Error(err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleInfluxFullLabelSet(t *testing.T) {
+	setupTestOptions(t, "--metrics-labelset=full")
+	target := apiTargets[0]
+
+	// azure_scheduledevent_event labels are set at registration, use unregistered metric with full label set
+	defer func(metric *prometheus.GaugeVec, labels []string) {
+		scheduledEvent, scheduledEventLabels = metric, labels
+	}(scheduledEvent, scheduledEventLabels)
+	scheduledEventLabels = scheduledEventLabelSets[labelSetFull]
+	scheduledEvent = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "azure_scheduledevent_event"}, scheduledEventLabels)
+
+	events := []AzureScheduledEvent{
+		{EventId: "event1", EventType: "Reboot", ResourceType: "VirtualMachine", EventStatus: "Scheduled", Resources: []string{"vm1"}, DurationInSeconds: 300},
+	}
+	updateTargetMetrics(context.Background(), target, events, nil)
+
+	recorder := httptest.NewRecorder()
+	handleInflux(context.Background()).ServeHTTP(recorder, httptest.NewRequest("GET", "/influx", nil))
+
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %v", lines)
+	}
+
+	// measurement and tags, fields (escaped spaces are not used in test data)
+	parts := strings.Split(lines[0], " ")
+	if len(parts) != 3 {
+		t.Fatalf("expected tags, fields and timestamp, got %q", lines[0])
+	}
+	if strings.Contains(parts[0], ",duration=") {
+		t.Errorf("expected duration label not to be exported as tag, got %q", parts[0])
+	}
+	if !strings.Contains(parts[0], ",eventType=Reboot") {
+		t.Errorf("expected eventType tag, got %q", parts[0])
+	}
+	if !strings.HasSuffix(parts[1], ",duration=300i") {
+		t.Errorf("expected duration field, got %q", parts[1])
+	}
+}
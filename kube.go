@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	kubeServiceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// marks nodes cordoned by the exporter, other cordons are never removed
+	kubeCordonAnnotation = "azure-scheduledevents-exporter/cordoned"
+)
+
+type (
+	KubeNode struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			Unschedulable bool `json:"unschedulable"`
+		} `json:"spec"`
+	}
+
+	kubeClient struct {
+		baseUrl    string
+		httpClient *http.Client
+	}
+)
+
+var (
+	kube *kubeClient
+
+	// event types which cause the node to be cordoned
+	kubeCordonEventTypes = []string{"Reboot", "Redeploy", "Terminate"}
+
+	// cordon state which was last applied to the node (only accessed by probe)
+	kubeCordonSynced bool
+	kubeCordonWanted bool
+
+	// due time of postponed cordon sync (--action-throttle, only accessed by probe)
+	kubeCordonDueTime time.Time
+)
+
+// creates Kubernetes API client from in-cluster (service account) config
+func setupKubeClient() {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		log.Fatal("--kube.cordon: not running inside Kubernetes (KUBERNETES_SERVICE_HOST/KUBERNETES_SERVICE_PORT not set)")
+	}
+
+	caCert, err := ioutil.ReadFile(kubeServiceAccountPath + "/ca.crt")
+	if err != nil {
+		log.Fatalf("--kube.cordon: unable to read service account ca: %v", err)
+	}
+
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caCert) {
+		log.Fatal("--kube.cordon: unable to parse service account ca")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: caPool, MinVersion: tls.VersionTLS12}
+
+	kube = &kubeClient{
+		baseUrl:    "https://" + net.JoinHostPort(host, port),
+		httpClient: &http.Client{Transport: transport},
+	}
+}
+
+// cordons node if a disruptive event exists for any target, uncordons node (if cordoned by exporter) if not
+func syncKubeCordon(ctx context.Context) {
+	if !opts.KubeCordon {
+		return
+	}
+
+	cordon, ok := kubeCordonWantedState(ctx)
+	if !ok {
+		return
+	}
+
+	// only sync state changes (failed syncs are retried next scrape)
+	if kubeCordonSynced && cordon == kubeCordonWanted {
+		kubeCordonDueTime = time.Time{}
+		return
+	}
+
+	nodeLogger := scrapeLogger(ctx).WithField("node", opts.NodeName)
+
+	// --action-throttle, --action-max-concurrent: postponed to later scrape
+	if !actionDue(&kubeCordonDueTime) {
+		nodeLogger.Debugf("postponing cordon sync of node \"%v\" until %v (--action-throttle)", opts.NodeName, kubeCordonDueTime.Format(time.RFC3339))
+		return
+	}
+	release, ok := tryAcquireAction()
+	if !ok {
+		nodeLogger.Debugf("postponing cordon sync of node \"%v\", max concurrent actions running", opts.NodeName)
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.ApiTimeout)
+	defer cancel()
+
+	node, err := kube.getNode(ctx, opts.NodeName)
+	if err != nil {
+		nodeLogger.Errorf("failed to get node \"%v\": %v", opts.NodeName, err)
+		return
+	}
+	cordonedByExporter := node.Metadata.Annotations[kubeCordonAnnotation] != ""
+
+	switch {
+	case cordon && node.Spec.Unschedulable:
+		nodeLogger.Infof("node \"%v\" is already cordoned", opts.NodeName)
+	case cordon:
+		nodeLogger.Infof("cordoning node \"%v\" because of disruptive scheduled event", opts.NodeName)
+		err := kube.patchNode(ctx, opts.NodeName, true, kubeCordonAnnotation, "true")
+		countAction(ctx, "cordon", err)
+		if err != nil {
+			nodeLogger.Errorf("failed to cordon node \"%v\": %v", opts.NodeName, err)
+			return
+		}
+		cordonedByExporter = true
+	case cordonedByExporter:
+		nodeLogger.Infof("uncordoning node \"%v\", disruptive scheduled events cleared", opts.NodeName)
+		err := kube.patchNode(ctx, opts.NodeName, false, kubeCordonAnnotation, nil)
+		countAction(ctx, "uncordon", err)
+		if err != nil {
+			nodeLogger.Errorf("failed to uncordon node \"%v\": %v", opts.NodeName, err)
+			return
+		}
+		cordonedByExporter = false
+	}
+
+	kubeCordonSynced = true
+	kubeCordonWanted = cordon
+	kubeCordonDueTime = time.Time{}
+
+	cordonedValue := float64(0)
+	if cordonedByExporter {
+		cordonedValue = 1
+	}
+	scheduledEventNodeCordoned.With(prometheus.Labels{"node": opts.NodeName}).Set(cordonedValue)
+}
+
+// returns if node should be cordoned (a disruptive event affects this VM), not ok if state is unknown
+func kubeCordonWantedState(ctx context.Context) (cordon bool, ok bool) {
+	// IMDS lists events of all VMs of the availability set or scale set, only events affecting this VM cordon
+	// the node, so nothing is synced until the name of this VM is known
+	vmName := kubeCordonVmName()
+	if vmName == "" {
+		scrapeLogger(ctx).WithField("node", opts.NodeName).Debugf("skipping cordon sync of node \"%v\", name of this VM is not known yet", opts.NodeName)
+		return false, false
+	}
+
+	// events are unknown until every target was fetched successfully (eg. failing API after restart),
+	// a node cordoned for a pending event must not be uncordoned
+	for _, target := range apiTargets {
+		if !target.fetchSucceeded {
+			scrapeLogger(ctx).WithField("node", opts.NodeName).Debugf("skipping cordon sync of node \"%v\", no successful API call of %v yet", opts.NodeName, target.Url)
+			return false, false
+		}
+		for _, event := range target.disruptiveEvents {
+			cordon = cordon || eventAffectsSelf(event, vmName) || eventAffectsSelf(event, opts.NodeName)
+		}
+	}
+
+	return cordon, true
+}
+
+// returns name of this VM for node cordon (--self-name or detected compute name), falls back to --kube.node-name
+// if compute name isn't detected (--dev.api-mock-file), empty while detection is pending
+func kubeCordonVmName() string {
+	if name := currentSelfName(); name != "" {
+		return name
+	}
+	if opts.ApiMockFile != "" {
+		return opts.NodeName
+	}
+	return ""
+}
+
+// checks if event type causes node cordon
+func eventTypeCordonsNode(event AzureScheduledEvent) bool {
+	for _, eventType := range kubeCordonEventTypes {
+		if strings.EqualFold(event.EventType, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *kubeClient) getNode(ctx context.Context, name string) (*KubeNode, error) {
+	node := &KubeNode{}
+	err := k.request(ctx, "GET", "/api/v1/nodes/"+url.PathEscape(name), "", nil, node)
+	return node, err
+}
+
+// sets unschedulable of node and sets annotation (removed if value is nil)
+func (k *kubeClient) patchNode(ctx context.Context, name string, unschedulable bool, annotation string, value interface{}) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{annotation: value},
+		},
+		"spec": map[string]interface{}{
+			"unschedulable": unschedulable,
+		},
+	}
+
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	return k.request(ctx, "PATCH", "/api/v1/nodes/"+url.PathEscape(name), "application/strategic-merge-patch+json", body, nil)
+}
+
+func (k *kubeClient) request(ctx context.Context, method, path, contentType string, body []byte, ret interface{}) error {
+	// token is re-read as it's rotated by kubelet
+	token, err := ioutil.ReadFile(kubeServiceAccountPath + "/token")
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.baseUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", opts.UserAgent)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, apiErrorBodyLimit))
+		return fmt.Errorf("unexpected status %v from Kubernetes API: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if ret != nil {
+		return json.NewDecoder(resp.Body).Decode(ret)
+	}
+	return nil
+}
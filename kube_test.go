@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestKubeCordonWantedState(t *testing.T) {
+	tests := []struct {
+		name      string
+		selfName  string
+		eventType string
+		resources string
+		status    int
+		cordon    bool
+		ok        bool
+	}{
+		{name: "event of this VM", selfName: "vm1", eventType: "Reboot", resources: `["vm1"]`, cordon: true, ok: true},
+		{name: "event of this VM (resource id)", selfName: "vm1", eventType: "Redeploy", resources: `["/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/VM1"]`, cordon: true, ok: true},
+		{name: "event of node name", selfName: "vm1", eventType: "Terminate", resources: `["aks-node-0"]`, cordon: true, ok: true},
+		{name: "event of sibling VM", selfName: "vm1", eventType: "Reboot", resources: `["vm2", "vm3"]`, ok: true},
+		{name: "non-disruptive event of this VM", selfName: "vm1", eventType: "Freeze", resources: `["vm1"]`, ok: true},
+		{name: "name of this VM not known", eventType: "Reboot", resources: `["vm1"]`},
+		{name: "failed API call", selfName: "vm1", eventType: "Reboot", resources: `["vm1"]`, status: http.StatusInternalServerError},
+	}
+
+	// metrics are registered without --kube.cordon (Kubernetes client requires in-cluster config)
+	setupTestOptions(t)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestOptions(t, "--kube.cordon", "--kube.node-name=aks-node-0", "--api-retry-count=0")
+			setSelfName(test.selfName)
+			defer setSelfName("")
+
+			status := test.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			body := fmt.Sprintf(`{"DocumentIncarnation":1,"Events":[{"EventId":"event1","EventType":%q,"ResourceType":"VirtualMachine","Resources":%s,"EventStatus":"Scheduled","NotBefore":"Mon, 19 Sep 2022 18:29:47 GMT"}]}`, test.eventType, test.resources)
+			newImdsTestServer(t, imdsTestResponse{status: status, body: body})
+
+			probeTarget(context.Background(), context.Background(), apiTargets[0])
+			cordon, ok := kubeCordonWantedState(context.Background())
+			if cordon != test.cordon || ok != test.ok {
+				t.Errorf("expected cordon %v (ok %v), got %v (ok %v)", test.cordon, test.ok, cordon, ok)
+			}
+		})
+	}
+}
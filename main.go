@@ -1,19 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/jessevdk/go-flags"
 	log "github.com/sirupsen/logrus"
 	"github.com/webdevops/azure-scheduledevents-exporter/config"
+	"net"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"regexp"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
 )
 
 const (
 	Author = "webdevops.io"
+	Name   = "azure-scheduledevents-exporter"
 )
 
 var (
@@ -23,6 +33,10 @@ var (
 	// Git version information
 	gitCommit = "<unknown>"
 	gitTag    = "<unknown>"
+	buildDate = "<unknown>"
+
+	// valid namespace/subsystem of Prometheus metric names
+	metricNamePartRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
 )
 
 func main() {
@@ -30,39 +44,84 @@ func main() {
 
 	log.Infof("starting Azure ScheduledEvents manager v%s (%s; %s; by %v)", gitTag, gitCommit, runtime.Version(), Author)
 	log.Info(string(opts.GetJson()))
+	if opts.ApiMockFile != "" {
+		log.Warnf("DEVELOPMENT MODE: Azure API is not called, events are read from mock file \"%v\" (--dev.api-mock-file)", opts.ApiMockFile)
+	}
+	for _, target := range apiTargets {
+		log.Infof("using Azure ScheduledEvents API URL %s", target.Url)
+	}
+
+	// cancelled on SIGTERM/SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
 	log.Infof("starting metrics collection")
-	setupMetricsCollection()
-	startMetricsCollection()
+	setupMetricsCollection(ctx)
+
+	// --require-azure: fail fast if not running on Azure VM
+	if opts.RequireAzure {
+		if opts.ApiMockFile != "" {
+			log.Warn("--require-azure: check skipped, --dev.api-mock-file is set")
+		} else if err := checkAzureInstance(ctx); err != nil {
+			log.Fatalf("--require-azure: Azure Instance Metadata Service not reachable, not running on Azure VM? %v", err)
+		} else {
+			log.Infof("--require-azure: Azure Instance Metadata Service is reachable")
+		}
+	}
+
+	startSelfNameDetection(ctx)
+	collectionDone := startMetricsCollection(ctx)
+	startConfigReload(ctx)
 
 	log.Infof("starting http server on %s", opts.ServerBind)
-	startHttpServer()
+	startHttpServer(ctx)
+
+	<-collectionDone
+
+	log.Infof("shutdown complete")
 }
 
 func initArgparser() {
-	argparser = flags.NewParser(&opts, flags.Default)
-	_, err := argparser.Parse()
+	parser, parsedOpts, err := parseOptions(os.Args[1:])
+	argparser = parser
 
 	// check if there is an parse error
 	if err != nil {
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
 			os.Exit(0)
-		} else {
+		} else if ok {
 			fmt.Println()
 			argparser.WriteHelp(os.Stdout)
 			os.Exit(1)
+		} else {
+			fmt.Println(err)
+			os.Exit(1)
 		}
 	}
 
-	// verbose level
-	if opts.Logger.Verbose {
-		log.SetLevel(log.DebugLevel)
+	applyOptionDefaults(parsedOpts)
+	opts = *parsedOpts
+
+	// --version
+	if opts.Version {
+		fmt.Printf("%s version=%s revision=%s builddate=%s goversion=%s\n", Name, gitTag, gitCommit, buildDate, runtime.Version())
+		os.Exit(0)
+	}
+
+	// --print-config
+	if opts.PrintConfig {
+		if err := printConfig(argparser); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
+	initLogLevel()
+
 	// debug level
 	if opts.Logger.Debug {
 		log.SetReportCaller(true)
-		log.SetLevel(log.TraceLevel)
 		log.SetFormatter(&log.TextFormatter{
 			CallerPrettyfier: func(f *runtime.Frame) (string, string) {
 				s := strings.Split(f.Function, ".")
@@ -73,10 +132,9 @@ func initArgparser() {
 	}
 
 	// json log format
-	if opts.Logger.LogJson {
+	if opts.Logger.LogFormat == "json" {
 		log.SetReportCaller(true)
 		log.SetFormatter(&log.JSONFormatter{
-			DisableTimestamp: true,
 			CallerPrettyfier: func(f *runtime.Frame) (string, string) {
 				s := strings.Split(f.Function, ".")
 				funcName := s[len(s)-1]
@@ -85,25 +143,242 @@ func initArgparser() {
 		})
 	}
 
+	if err := validateOptions(&opts); err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
+	// --api-url (validated by validateOptions)
+	for _, val := range opts.ApiUrl {
+		apiUrl, _ := url.Parse(val)
+
+		// --api-version
+		if opts.ApiVersion != "" {
+			query := apiUrl.Query()
+			query.Set("api-version", opts.ApiVersion)
+			apiUrl.RawQuery = query.Encode()
+		}
+
+		apiTargets = append(apiTargets, &ApiTarget{Url: apiUrl.String(), lastSuccessTime: time.Now()})
+	}
+}
+
+// validates options, returned error names the invalid option
+func validateOptions(o *config.Opts) error {
+	// --api-host
+	if o.ApiHost != "" {
+		apiHost, err := url.Parse(o.ApiHost)
+		if err != nil || (apiHost.Scheme != "http" && apiHost.Scheme != "https") || apiHost.Host == "" || strings.Trim(apiHost.Path, "/") != "" {
+			return fmt.Errorf("--api-host: invalid value \"%v\" (must be http or https scheme and host only)", o.ApiHost)
+		}
+	}
+
 	// --api-url
-	apiUrl, err := url.Parse(opts.ApiUrl)
-	if err != nil {
-		fmt.Println(err)
-		fmt.Println()
-		argparser.WriteHelp(os.Stdout)
-		os.Exit(1)
-	}
-
-	// validate --api-url scheme
-	switch strings.ToLower(apiUrl.Scheme) {
-	case "http":
-		break
-	case "https":
-		break
-	default:
-		fmt.Println("ApiURL scheme not allowed (must be http or https)")
-		fmt.Println()
-		argparser.WriteHelp(os.Stdout)
-		os.Exit(1)
+	if len(o.ApiUrl) == 0 {
+		return errors.New("--api-url: at least one Azure ScheduledEvents API URL is required")
+	}
+	for _, val := range o.ApiUrl {
+		apiUrl, err := url.Parse(val)
+		if err != nil {
+			return fmt.Errorf("--api-url: invalid URL \"%v\": %w", val, err)
+		}
+
+		switch strings.ToLower(apiUrl.Scheme) {
+		case "http", "https":
+		default:
+			return fmt.Errorf("--api-url: scheme of \"%v\" not allowed (must be http or https)", val)
+		}
+
+		if apiUrl.Host == "" {
+			return fmt.Errorf("--api-url: host missing in \"%v\"", val)
+		}
+	}
+
+	// --webhook.url
+	if o.WebhookUrl != "" {
+		webhookUrl, err := url.Parse(o.WebhookUrl)
+		if err != nil || (webhookUrl.Scheme != "http" && webhookUrl.Scheme != "https") || webhookUrl.Host == "" {
+			return errors.New("--webhook.url: invalid URL (must be http or https)")
+		}
+	}
+
+	// --scrape-time, --api-timeout, --cache-ttl
+	if o.ScrapeTime <= 0 {
+		return fmt.Errorf("--scrape-time: must be positive, got %v", o.ScrapeTime)
+	}
+	if o.ScrapeTimeout < 0 {
+		return fmt.Errorf("--scrape-timeout: must not be negative, got %v", o.ScrapeTimeout)
+	}
+	if o.ApiTimeout <= 0 {
+		return fmt.Errorf("--api-timeout: must be positive, got %v", o.ApiTimeout)
+	}
+	if o.EventRetention < 0 {
+		return fmt.Errorf("--event-retention: must not be negative, got %v", o.EventRetention)
+	}
+	if o.CacheTtl < 0 {
+		return fmt.Errorf("--cache-ttl: must not be negative, got %v", o.CacheTtl)
+	}
+	if o.ApiErrorWindow < 0 {
+		return fmt.Errorf("--api-error-window: must not be negative, got %v", o.ApiErrorWindow)
+	}
+	if o.MinFetchInterval < 0 {
+		return fmt.Errorf("--api-min-fetch-interval: must not be negative, got %v", o.MinFetchInterval)
+	}
+
+	// --api-retry-count, --api-retry-delay
+	if o.ApiRetryCount < 0 {
+		return fmt.Errorf("--api-retry-count: must not be negative, got %v", o.ApiRetryCount)
+	}
+	if o.ApiRetryDelay < 0 {
+		return fmt.Errorf("--api-retry-delay: must not be negative, got %v", o.ApiRetryDelay)
+	}
+
+	// --api-bearer-token-file
+	if o.ApiBearerTokenFile != "" {
+		if _, err := os.Stat(o.ApiBearerTokenFile); err != nil {
+			return fmt.Errorf("--api-bearer-token-file: %w", err)
+		}
+	}
+
+	// --api-header
+	for name, value := range o.ApiHeaders {
+		if !validHeaderName(name) {
+			return fmt.Errorf("--api-header: invalid header name \"%v\"", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("--api-header: invalid value of header \"%v\"", name)
+		}
+	}
+
+	// --api-interface
+	if o.ApiInterface != "" {
+		if _, err := net.InterfaceByName(o.ApiInterface); err != nil {
+			return fmt.Errorf("--api-interface: %w", err)
+		}
+	}
+
+	// --bind
+	if _, _, err := net.SplitHostPort(o.ServerBind); err != nil {
+		return fmt.Errorf("--bind: invalid address \"%v\": %w", o.ServerBind, err)
+	}
+
+	// --metrics-path
+	switch {
+	case !strings.HasPrefix(o.MetricsPath, "/"):
+		return fmt.Errorf("--metrics-path: must start with /, got \"%v\"", o.MetricsPath)
+	case o.MetricsPath == "/", o.MetricsPath == "/healthz", o.MetricsPath == "/readyz", o.MetricsPath == "/events":
+		return fmt.Errorf("--metrics-path: \"%v\" conflicts with a builtin endpoint", o.MetricsPath)
+	case o.EnablePprof && strings.HasPrefix(o.MetricsPath, "/debug/pprof/"):
+		return fmt.Errorf("--metrics-path: \"%v\" conflicts with a builtin endpoint", o.MetricsPath)
+	case o.EnableInflux && o.MetricsPath == "/influx":
+		return fmt.Errorf("--metrics-path: \"%v\" conflicts with a builtin endpoint", o.MetricsPath)
+	}
+
+	// --metrics-namespace, --metrics-subsystem
+	if o.MetricsNamespace != "" && !metricNamePartRegexp.MatchString(o.MetricsNamespace) {
+		return fmt.Errorf("--metrics-namespace: invalid metric name prefix \"%v\"", o.MetricsNamespace)
+	}
+	if o.MetricsSubsystem != "" && !metricNamePartRegexp.MatchString(o.MetricsSubsystem) {
+		return fmt.Errorf("--metrics-subsystem: invalid metric name prefix \"%v\"", o.MetricsSubsystem)
+	}
+
+	// --dev.api-mock-file
+	if o.ApiMockFile != "" {
+		if _, err := os.Stat(o.ApiMockFile); err != nil {
+			return fmt.Errorf("--dev.api-mock-file: %w", err)
+		}
+	}
+
+	// --api-tls.cert, --api-tls.key, --api-tls.ca
+	if _, err := loadApiTlsConfig(o); err != nil {
+		return err
+	}
+
+	// --action-throttle, --action-max-concurrent
+	if o.ActionThrottle < 0 {
+		return fmt.Errorf("--action-throttle: must not be negative, got %v", o.ActionThrottle)
+	}
+	if o.ActionMaxConcurrent < 0 {
+		return fmt.Errorf("--action-max-concurrent: must not be negative, got %v", o.ActionMaxConcurrent)
+	}
+
+	// --auto-approve-event-status, only scheduled events can be started
+	for _, status := range o.AutoApproveStatuses {
+		if !strings.EqualFold(status, "Scheduled") {
+			return fmt.Errorf("--auto-approve-event-status: only events in status Scheduled can be approved, got \"%v\"", status)
+		}
+	}
+
+	// --kube.cordon
+	if o.KubeCordon && o.NodeName == "" {
+		return errors.New("--kube.node-name: node name is required for --kube.cordon")
+	}
+
+	// --tls.cert, --tls.key
+	if o.TlsCertFile != "" || o.TlsKeyFile != "" {
+		if o.TlsCertFile == "" || o.TlsKeyFile == "" {
+			return errors.New("--tls.cert, --tls.key: both must be set for TLS")
+		}
+
+		if _, err := tls.LoadX509KeyPair(o.TlsCertFile, o.TlsKeyFile); err != nil {
+			return fmt.Errorf("--tls.cert, --tls.key: unable to load TLS certificate/key: %w", err)
+		}
+	}
+
+	if o.ApiTimeout >= o.ScrapeTime {
+		log.Warnf("--api-timeout (%v) is not lower than --scrape-time (%v), API calls may not finish before next scrape", o.ApiTimeout, o.ScrapeTime)
+	}
+
+	return nil
+}
+
+// checks if name is a valid http header name (RFC 7230 token)
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if c > unicode.MaxASCII || !(unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sets options which are derived from other options
+func applyOptionDefaults(o *config.Opts) {
+	// --log.json
+	if o.Logger.LogJson {
+		o.Logger.LogFormat = "json"
+	}
+
+	// --api-useragent
+	if o.UserAgent == "" {
+		o.UserAgent = fmt.Sprintf("%s/%s", Name, gitTag)
+	}
+}
+
+func initLogLevel() {
+	// log level
+	switch opts.Logger.LogLevel {
+	case "error":
+		log.SetLevel(log.ErrorLevel)
+	case "warn":
+		log.SetLevel(log.WarnLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	case "verbose", "debug":
+		log.SetLevel(log.DebugLevel)
+	}
+
+	// verbose level
+	if opts.Logger.Verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	// debug level
+	if opts.Logger.Debug {
+		log.SetLevel(log.TraceLevel)
 	}
 }
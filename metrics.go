@@ -1,43 +1,314 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	dto "github.com/prometheus/client_model/go"
 	log "github.com/sirupsen/logrus"
-	"net/http"
+	"math"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type AzureScheduledEventResponse struct {
-	DocumentIncarnation int                   `json:"DocumentIncarnation"`
-	Events              []AzureScheduledEvent `json:"Events"`
-}
+const (
+	// --metrics-event-value modes
+	eventValueNotBefore = "notbefore"
+	eventValuePresence  = "presence"
 
-type AzureScheduledEvent struct {
-	EventId      string   `json:"EventId"`
-	EventType    string   `json:"EventType"`
-	ResourceType string   `json:"ResourceType"`
-	Resources    []string `json:"Resources"`
-	EventStatus  string   `json:"EventStatus"`
-	NotBefore    string   `json:"NotBefore"`
-}
+	// --metrics-labelset presets
+	labelSetMinimal  = "minimal"
+	labelSetStandard = "standard"
+	labelSetFull     = "full"
+)
 
 var (
+	// registry of all exported metrics (served by metrics endpoint)
+	metricsRegistry = NewMetricsRegistry()
+
 	scheduledEventDocumentIncarnation = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "azure_scheduledevent_document_incarnation",
-			Help: "Azure ScheduledEvent document incarnation",
+			Help: "Azure ScheduledEvent document incarnation of last successful scrape",
+		},
+		[]string{"target"},
+	)
+
+	// created in setupMetricsCollection (labels depend on options)
+	scheduledEvent       *prometheus.GaugeVec
+	scheduledEventLabels []string
+
+	// labels of azure_scheduledevent_event by --metrics-labelset
+	scheduledEventLabelSets = map[string][]string{
+		labelSetMinimal:  {"target", "eventID", "eventType"},
+		labelSetStandard: {"target", "eventID", "eventType", "resourceType", "resource", "eventStatus", "eventSource"},
+		labelSetFull:     {"target", "eventID", "eventType", "resourceType", "resource", "eventStatus", "eventSource", "description", "duration"},
+	}
+
+	scheduledEventUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevents_up",
+			Help: "Azure ScheduledEvents last scrape status (1 = success, 0 = failed)",
+		},
+		[]string{"target"},
+	)
+
+	scheduledEventApiErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevents_api_errors_total",
+			Help: "Azure ScheduledEvents failed API calls (reason: network, status, decode or unknown)",
+		},
+		[]string{"target", "reason"},
+	)
+
+	scheduledEventDecodeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevents_decode_errors_total",
+			Help: "Azure ScheduledEvents API responses which could not be decoded (malformed json)",
+		},
+		[]string{"target"},
+	)
+
+	scheduledEventLastScrape = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevents_last_scrape_timestamp_seconds",
+			Help: "Azure ScheduledEvents timestamp of last successful scrape",
+		},
+		[]string{"target"},
+	)
+
+	scheduledEventFetch = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevents_fetch_total",
+			Help: "Azure ScheduledEvents scrape runs",
 		},
 		[]string{},
 	)
 
-	scheduledEvent = prometheus.NewGaugeVec(
+	scheduledEventFetchSuccess = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevents_fetch_success_total",
+			Help: "Azure ScheduledEvents scrape runs without failed targets",
+		},
+		[]string{},
+	)
+
+	scheduledEventFetchSource = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevents_fetch_source_total",
+			Help: "Azure ScheduledEvents scrapes of target by source (api: Azure API call, cache: skipped because of api-min-fetch-interval)",
+		},
+		[]string{"target", "source"},
+	)
+
+	scheduledEventScrapeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "azure_scheduledevents_scrape_duration_seconds",
+			Help:    "Azure ScheduledEvents scrape duration (API call and metric update)",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		},
+		[]string{},
+	)
+
+	scheduledEventApiRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "azure_scheduledevents_api_request_duration_seconds",
+			Help: "Azure ScheduledEvents API request duration (http request until response headers, per attempt)",
+			// IMDS is link-local, responses are expected within milliseconds
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		},
+		[]string{"target"},
+	)
+
+	scheduledEventAction = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevent_action_total",
+			Help: "Azure ScheduledEvent side-effecting actions of exporter (action: cordon, uncordon, approve, webhook, command; result: success, error)",
+		},
+		[]string{"action", "result"},
+	)
+
+	scheduledEventResourceTypeCount = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "azure_scheduledevent_event",
-			Help: "Azure ScheduledEvent",
+			Name: "azure_scheduledevent_resource_type_count",
+			Help: "Azure ScheduledEvent count of affected resources (event, resource pairs) by resource type (0 if type has disappeared)",
+		},
+		[]string{"target", "resourceType"},
+	)
+
+	scheduledEventMissingFieldSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevent_missing_field_skipped_total",
+			Help: "Azure ScheduledEvent events skipped because of missing field (EventId always, others with on-missing-field=skip)",
+		},
+		[]string{"target", "field"},
+	)
+
+	scheduledEventInternalInconsistency = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevents_internal_inconsistency_total",
+			Help: "Azure ScheduledEvents self-check failures (exported event series don't match event list, exporter bug)",
+		},
+		[]string{"target"},
+	)
+
+	scheduledEventDocumentIncarnationChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevent_document_incarnation_changes_total",
+			Help: "Azure ScheduledEvent document incarnation changes",
+		},
+		[]string{"target"},
+	)
+
+	scheduledEventInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_info",
+			Help: "Azure ScheduledEvent information (always 1, description as label)",
 		},
-		[]string{"eventID", "eventType", "resourceType", "resource", "eventStatus", "notBefore"},
+		[]string{"target", "eventID", "description"},
+	)
+
+	scheduledEventCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_count",
+			Help: "Azure ScheduledEvent count of active events",
+		},
+		[]string{"target", "eventType", "eventStatus"},
+	)
+
+	scheduledEventStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_status",
+			Help: "Azure ScheduledEvent status (1 for current status, 0 for others)",
+		},
+		[]string{"target", "eventID", "eventStatus"},
+	)
+
+	scheduledEventNotBeforeSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_not_before_seconds",
+			Help: "Azure ScheduledEvent seconds until NotBefore (negative if passed)",
+		},
+		[]string{"target", "eventID"},
+	)
+
+	scheduledEventNew = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_new",
+			Help: "Azure ScheduledEvent was not present in previous successful scrape",
+		},
+		[]string{"target", "eventID"},
+	)
+
+	scheduledEventImminent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_imminent",
+			Help: "Azure ScheduledEvent NotBefore has passed, maintenance is imminent or in progress (0 if NotBefore is not set)",
+		},
+		[]string{"target", "eventID"},
+	)
+
+	scheduledEventStale = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_event_stale",
+			Help: "Azure ScheduledEvent disappeared from API response, metrics are kept for --event-retention",
+		},
+		[]string{"target", "eventID"},
+	)
+
+	scheduledEventAffectsSelf = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_affects_self",
+			Help: "Azure ScheduledEvent affects this VM (--self-name or compute name of IMDS instance metadata is one of the resources)",
+		},
+		[]string{"target", "eventID"},
+	)
+
+	scheduledEventTimeToNextEvent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_time_to_next_event_seconds",
+			Help: "Azure ScheduledEvent seconds until NotBefore of next upcoming event (absent if none)",
+		},
+		[]string{"target"},
+	)
+
+	scheduledEventNotBeforeInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_not_before_info",
+			Help: "Azure ScheduledEvent NotBefore as sent by API (always 1, raw NotBefore as label)",
+		},
+		[]string{"target", "eventID", "notBefore"},
+	)
+
+	scheduledEventNotBeforeParseErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevent_notbefore_parse_errors_total",
+			Help: "Azure ScheduledEvent NotBefore values which could not be parsed",
+		},
+		[]string{"target"},
+	)
+
+	scheduledEventResourceCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_resource_count",
+			Help: "Azure ScheduledEvent count of resources affected by event",
+		},
+		[]string{"target", "eventID"},
+	)
+
+	scheduledEventDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_duration_seconds",
+			Help: "Azure ScheduledEvent expected impact duration in seconds (-1 if unknown)",
+		},
+		[]string{"target", "eventID"},
+	)
+
+	scheduledEventProbePanics = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevents_probe_panics_total",
+			Help: "Azure ScheduledEvents recovered panics of scrapes (api-error-behavior=continue)",
+		},
+		[]string{},
+	)
+
+	scheduledEventApproveDryRun = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevent_approve_dryrun_total",
+			Help: "Azure ScheduledEvent events which would have been approved (dry run)",
+		},
+		[]string{"target"},
+	)
+
+	scheduledEventNodeCordoned = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_node_cordoned",
+			Help: "Azure ScheduledEvent Kubernetes node cordoned by exporter because of disruptive event (kube-cordon)",
+		},
+		[]string{"node"},
+	)
+
+	scheduledEventWebhookErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azure_scheduledevent_webhook_errors_total",
+			Help: "Azure ScheduledEvent failed webhook notifications",
+		},
+		[]string{},
+	)
+
+	scheduledEventBuildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevents_build_info",
+			Help: "Azure ScheduledEvents exporter build information",
+		},
+		[]string{"version", "revision", "builddate", "goversion"},
 	)
 
 	scheduledEventRequest = prometheus.NewHistogramVec(
@@ -45,7 +316,7 @@ var (
 			Name: "azure_scheduledevent_request",
 			Help: "Azure ScheduledEvent requests",
 		},
-		[]string{},
+		[]string{"target"},
 	)
 
 	scheduledEventRequestError = prometheus.NewCounterVec(
@@ -53,149 +324,853 @@ var (
 			Name: "azure_scheduledevent_request_error",
 			Help: "Azure ScheduledEvent failed requests",
 		},
-		[]string{},
+		[]string{"target"},
 	)
 
-	timeFormatList = []string{
-		time.RFC3339,
-		time.RFC1123,
-		time.RFC822Z,
-		time.RFC850,
+	// side-effecting actions (azure_scheduledevent_action_total)
+	actionList = []string{"cordon", "uncordon", "approve", "webhook", "command"}
+
+	// help of azure_scheduledevent_event by --metrics-event-value, must match value set in updateTargetMetrics
+	scheduledEventHelp = map[string]string{
+		eventValueNotBefore: "Azure ScheduledEvent per affected resource (value: NotBefore as unix timestamp, 1 if NotBefore is not set, NaN if NotBefore is unparseable)",
+		eventValuePresence:  "Azure ScheduledEvent per affected resource (value: always 1, NotBefore is available via azure_scheduledevent_not_before_seconds)",
 	}
 
-	httpClient *http.Client
+	// known Azure ScheduledEvent status values (exported as enum)
+	eventStatusList = []string{"Scheduled", "Started"}
+
+	// set to 1 while probeCollect is running
+	probeRunning int32
+
+	// held while probeCollect is running (and while options are reloaded)
+	probeLock sync.Mutex
+
+	// protects collection state (lastSuccessTime and state of targets)
+	collectionLock sync.RWMutex
+
+	// held (write) while event metrics are reset and repopulated, (read) while metrics are collected
+	metricsLock sync.RWMutex
 
-	apiErrorCount = 0
+	// last successful scrape of any target
+	lastSuccessTime time.Time
 )
 
-func setupMetricsCollection() {
-	prometheus.MustRegister(scheduledEvent)
-	prometheus.MustRegister(scheduledEventDocumentIncarnation)
-	prometheus.MustRegister(scheduledEventRequest)
-	prometheus.MustRegister(scheduledEventRequestError)
+// NewMetricsRegistry creates a metrics registry with Go runtime and process collectors
+// (metricsRegistry can be replaced before setupMetricsCollection for isolated registries)
+func NewMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return registry
+}
+
+// builds metric name prefix from --metrics-namespace and --metrics-subsystem (empty if none is set)
+func metricsPrefix() string {
+	parts := []string{}
+	for _, part := range []string{opts.MetricsNamespace, opts.MetricsSubsystem} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, "_") + "_"
+}
+
+func setupMetricsCollection(ctx context.Context) {
+	// --metrics-labelset
+	scheduledEventLabels = append([]string{}, scheduledEventLabelSets[opts.LabelSet]...)
+	if opts.NotBeforeAsLabel {
+		scheduledEventLabels = append(scheduledEventLabels, "notBefore")
+	}
+
+	scheduledEvent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azure_scheduledevent_event",
+			Help: scheduledEventHelp[opts.EventValueMode],
+		},
+		scheduledEventLabels,
+	)
+
+	// --metrics-namespace, --metrics-subsystem: prefix all exporter metrics (same as prometheus.Opts Namespace/Subsystem)
+	registerer := prometheus.WrapRegistererWithPrefix(metricsPrefix(), metricsRegistry)
+
+	registerer.MustRegister(NewScheduledEventsCollector(
+		ctx,
+		scheduledEvent,
+		scheduledEventDocumentIncarnation,
+		scheduledEventDocumentIncarnationChanges,
+		scheduledEventInfo,
+		scheduledEventCount,
+		scheduledEventStatus,
+		scheduledEventNotBeforeSeconds,
+		scheduledEventNotBeforeInfo,
+		scheduledEventTimeToNextEvent,
+		scheduledEventImminent,
+		scheduledEventStale,
+		scheduledEventAffectsSelf,
+		scheduledEventNew,
+		scheduledEventNotBeforeParseErrors,
+		scheduledEventDuration,
+		scheduledEventResourceCount,
+		scheduledEventResourceTypeCount,
+		scheduledEventUp,
+		scheduledEventApiErrors,
+		scheduledEventDecodeErrors,
+		scheduledEventScrapeDuration,
+		scheduledEventApiRequestDuration,
+		scheduledEventFetch,
+		scheduledEventFetchSuccess,
+		scheduledEventFetchSource,
+		scheduledEventLastScrape,
+		scheduledEventProbePanics,
+		scheduledEventApproveDryRun,
+		scheduledEventNodeCordoned,
+		scheduledEventWebhookErrors,
+		scheduledEventAction,
+		scheduledEventInternalInconsistency,
+		scheduledEventMissingFieldSkipped,
+		scheduledEventRequest,
+		scheduledEventRequestError,
+		NewDataAgeCollector(),
+	))
+
+	// initialize counters so ratios are available before the first success
+	scheduledEventFetch.With(prometheus.Labels{})
+	scheduledEventFetchSuccess.With(prometheus.Labels{})
+	for _, action := range actionList {
+		for _, result := range []string{"success", "error"} {
+			scheduledEventAction.With(prometheus.Labels{"action": action, "result": result})
+		}
+	}
+
+	registerer.MustRegister(scheduledEventBuildInfo)
+	scheduledEventBuildInfo.With(prometheus.Labels{
+		"version":   gitTag,
+		"revision":  gitCommit,
+		"builddate": buildDate,
+		"goversion": runtime.Version(),
+	}).Set(1)
 
-	apiErrorCount = 0
+	setupHttpClient()
+	setupActionThrottle()
 
-	// Init http client
-	httpClient = &http.Client{
-		Timeout: opts.ApiTimeout,
+	if opts.KubeCordon {
+		setupKubeClient()
 	}
 }
 
-func startMetricsCollection() {
+// starts background collection, returned channel is closed after collection is stopped (ctx cancelled)
+// and running scrapes are finished
+func startMetricsCollection(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+
+	// --collection-mode=onscrape: metrics are only collected by Prometheus scrapes
+	if opts.CollectionMode == "onscrape" {
+		log.Infof("background collection disabled, collecting metrics on scrape")
+		close(done)
+		return done
+	}
+
 	go func() {
+		defer close(done)
+
+		probeWg := sync.WaitGroup{}
+		scrapeTime := currentScrapeTime()
+
+		// spread API calls of simultaneously started instances (eg. DaemonSet rollout) across scrape interval
+		if !opts.NoStartupJitter {
+			jitter := time.Duration(rand.Int63n(int64(scrapeTime)))
+			log.Infof("delaying first scrape by %v (startup jitter)", jitter.Round(time.Millisecond))
+			select {
+			case <-ctx.Done():
+				log.Infof("stopping metrics collection")
+				return
+			case <-time.After(jitter):
+			}
+		}
+
+		ticker := time.NewTicker(scrapeTime)
+		defer ticker.Stop()
+
 		for {
-			go probeCollect()
-			time.Sleep(opts.ScrapeTime)
+			probeWg.Add(1)
+			go func() {
+				defer probeWg.Done()
+				runProbeCollect(ctx)
+			}()
+
+			select {
+			case <-ctx.Done():
+				log.Infof("stopping metrics collection")
+				probeWg.Wait()
+				return
+			case <-ticker.C:
+			}
+
+			// scrape time can be changed by config reload
+			if reloadedScrapeTime := currentScrapeTime(); reloadedScrapeTime != scrapeTime {
+				scrapeTime = reloadedScrapeTime
+				ticker.Reset(scrapeTime)
+			}
+		}
+	}()
+
+	return done
+}
+
+func currentScrapeTime() time.Duration {
+	collectionLock.RLock()
+	defer collectionLock.RUnlock()
+	return opts.ScrapeTime
+}
+
+// returns --api-timeout, can be changed by config reload
+func currentApiTimeout() time.Duration {
+	collectionLock.RLock()
+	defer collectionLock.RUnlock()
+	return opts.ApiTimeout
+}
+
+type scrapeIdKey struct{}
+
+// returns logger with scrape_id of running scrape (if any)
+func scrapeLogger(ctx context.Context) *log.Entry {
+	if scrapeId, ok := ctx.Value(scrapeIdKey{}).(string); ok {
+		return log.WithField("scrape_id", scrapeId)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// returns exemplar labels with scrape_id of running scrape (nil if none)
+// exemplars are only exposed via OpenMetrics and only supported for counters and histograms (not for gauges)
+func scrapeExemplar(ctx context.Context) prometheus.Labels {
+	if scrapeId, ok := ctx.Value(scrapeIdKey{}).(string); ok {
+		return prometheus.Labels{"scrape_id": scrapeId}
+	}
+	return nil
+}
+
+// increments counter with scrape_id as exemplar
+func incWithExemplar(ctx context.Context, counter prometheus.Counter) {
+	if exemplarAdder, ok := counter.(prometheus.ExemplarAdder); ok {
+		if labels := scrapeExemplar(ctx); labels != nil {
+			exemplarAdder.AddWithExemplar(1, labels)
+			return
+		}
+	}
+	counter.Inc()
+}
+
+// observes value with scrape_id as exemplar
+func observeWithExemplar(ctx context.Context, observer prometheus.Observer, value float64) {
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok {
+		if labels := scrapeExemplar(ctx); labels != nil {
+			exemplarObserver.ObserveWithExemplar(value, labels)
+			return
+		}
+	}
+	observer.Observe(value)
+}
+
+// runs probeCollect unless previous run is still in progress
+func runProbeCollect(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&probeRunning, 0, 1) {
+		scrapeLogger(ctx).Warn("skipping scrape, previous scrape is still running")
+		return
+	}
+	defer atomic.StoreInt32(&probeRunning, 0)
+
+	probeLock.Lock()
+	defer probeLock.Unlock()
+
+	atomic.StoreInt64(&lastProbeTime, time.Now().UnixNano())
+
+	// all log lines of this scrape contain scrape_id
+	ctx = context.WithValue(ctx, scrapeIdKey{}, fmt.Sprintf("%08x", rand.Uint32()))
+
+	defer func() {
+		if opts.ApiErrorBehavior != "continue" {
+			return
+		}
+
+		if r := recover(); r != nil {
+			scrapeLogger(ctx).Errorf("recovered from panic in scrape, continuing: %v", r)
+			scheduledEventProbePanics.With(prometheus.Labels{}).Inc()
 		}
 	}()
+
+	probeCollect(ctx)
 }
 
-func startHttpServer() {
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(opts.ServerBind, nil))
+func probeCollect(ctx context.Context) {
+	startTime := time.Now()
+	defer func() {
+		observeWithExemplar(ctx, scheduledEventScrapeDuration.With(prometheus.Labels{}), time.Since(startTime).Seconds())
+	}()
+
+	scheduledEventFetch.With(prometheus.Labels{}).Inc()
+
+	// --scrape-timeout: bounds API calls (including retries) of all targets, async hooks use ctx
+	scrapeCtx := ctx
+	if opts.ScrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		scrapeCtx, cancel = context.WithTimeout(ctx, opts.ScrapeTimeout)
+		defer cancel()
+	}
+
+	// failures of one target don't affect the others
+	success := true
+	for _, target := range apiTargets {
+		if scrapeCtx.Err() != nil {
+			break
+		}
+		probeTarget(ctx, scrapeCtx, target)
+		success = success && target.errorCount == 0
+	}
+
+	if ctx.Err() == nil && scrapeCtx.Err() != nil {
+		scrapeLogger(ctx).Warnf("scrape cut short after %v (--scrape-timeout), remaining API calls were cancelled", opts.ScrapeTimeout)
+		success = false
+	}
+
+	if success {
+		scheduledEventFetchSuccess.With(prometheus.Labels{}).Inc()
+	}
+
+	syncKubeCordon(ctx)
 }
 
-func probeCollect() {
-	scheduledEvents, err := fetchApiUrl()
+// counts side-effecting action by result
+func countAction(ctx context.Context, action string, err error) {
+	result := "success"
 	if err != nil {
-		apiErrorCount++
+		result = "error"
+	}
+	incWithExemplar(ctx, scheduledEventAction.With(prometheus.Labels{"action": action, "result": result}))
+}
+
+// returns reason label of failed API call
+func apiErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrNetwork):
+		return "network"
+	case errors.Is(err, ErrHTTPStatus):
+		return "status"
+	case errors.Is(err, ErrDecode):
+		return "decode"
+	default:
+		return "unknown"
+	}
+}
+
+func probeTarget(ctx, scrapeCtx context.Context, target *ApiTarget) {
+	targetLabels := prometheus.Labels{"target": target.Url}
+
+	// --api-min-fetch-interval, metrics of last API call are kept
+	if opts.MinFetchInterval > 0 && time.Since(target.lastFetchTime) < opts.MinFetchInterval {
+		scrapeLogger(ctx).WithField("url", target.Url).Debugf("skipping API call, last call was less than %v ago", opts.MinFetchInterval)
+		incWithExemplar(ctx, scheduledEventFetchSource.With(prometheus.Labels{"target": target.Url, "source": "cache"}))
+		return
+	}
+	target.lastFetchTime = time.Now()
+	incWithExemplar(ctx, scheduledEventFetchSource.With(prometheus.Labels{"target": target.Url, "source": "api"}))
+
+	scheduledEvents, err := fetchApiUrl(scrapeCtx, target.Url)
+	if err != nil && ctx.Err() != nil {
+		// shutdown in progress, no api error (--scrape-timeout is handled as failed API call)
+		scrapeLogger(ctx).Debugf("scrape cancelled: %v", err)
+		return
+	} else if err != nil {
+		reason := apiErrorReason(err)
+		errorCount := target.registerError()
+		incWithExemplar(ctx, scheduledEventApiErrors.With(prometheus.Labels{"target": target.Url, "reason": reason}))
+		scheduledEventUp.With(targetLabels).Set(0)
 
-		if opts.ApiErrorThreshold <= 0 || apiErrorCount <= opts.ApiErrorThreshold {
-			log.Errorf("failed API call: %v", err)
+		// metrics of last successful scrape are kept (stale data is visible via data_age_seconds)
+		if opts.ApiErrorThreshold <= 0 || errorCount <= opts.ApiErrorThreshold {
+			scrapeLogger(ctx).WithFields(log.Fields{
+				"url":    target.Url,
+				"reason": reason,
+			}).Errorf("failed API call: %v", err)
 			return
 		} else {
-			log.Panic(err)
+			scrapeLogger(ctx).Panic(err)
 		}
 	}
 
-	// reset error count and metrics
-	apiErrorCount = 0
-	scheduledEvent.Reset()
+	// reset error count
+	target.errorCount = 0
+	target.fetchSucceeded = true
+
+	// EventIds of this scrape, events missing in the response are forgotten
+	seenEventIds := map[string]bool{}
 
+	// filter events, approval and hooks are done before metrics are updated as they might block
+	events := []AzureScheduledEvent{}
+	newEvents := []AzureScheduledEvent{}
+	target.disruptiveEvents = nil
 	for _, event := range scheduledEvents.Events {
+		event, ok := handleMissingFields(ctx, target, event)
+		if !ok {
+			continue
+		}
+		event.Resources = normalizeResourceNames(event.Resources)
+
+		if !eventTypeAllowed(event.EventType) {
+			scrapeLogger(ctx).WithFields(log.Fields{
+				"eventId":   event.EventId,
+				"eventType": event.EventType,
+			}).Debugf("filtered event \"%v\" of type \"%v\"", event.EventId, event.EventType)
+			continue
+		}
+
+		autoApproveEvent(scrapeCtx, target, scheduledEvents.DocumentIncarnation, event)
+
+		// hooks are only run once per EventId
+		if !target.seenEventIds[event.EventId] && !seenEventIds[event.EventId] {
+			runEventCommand(ctx, target, event)
+			newEvents = append(newEvents, event)
+		}
+		seenEventIds[event.EventId] = true
+
+		if eventTypeCordonsNode(event) {
+			target.disruptiveEvents = append(target.disruptiveEvents, event)
+		}
+		events = append(events, event)
+	}
+
+	// retained events are not treated as new (hooks, webhook) if they reappear
+	staleEvents, staleEventIds := retainEvents(target, events)
+	for _, event := range staleEvents {
+		seenEventIds[event.EventId] = true
+		if eventTypeCordonsNode(event) {
+			target.disruptiveEvents = append(target.disruptiveEvents, event)
+		}
+	}
+	events = append(events, staleEvents...)
+
+	updateTargetMetrics(ctx, target, events, staleEventIds)
+
+	target.seenEventIds = seenEventIds
+	sendWebhook(ctx, target, newEvents)
+
+	scheduledEventDocumentIncarnation.With(targetLabels).Set(float64(scheduledEvents.DocumentIncarnation))
+	scheduledEventUp.With(targetLabels).Set(1)
+	collectionLock.Lock()
+	if !target.documentIncarnationSeen {
+		target.documentIncarnationChangeTime = time.Now()
+	} else if scheduledEvents.DocumentIncarnation != target.lastDocumentIncarnation {
+		scrapeLogger(ctx).WithField("url", target.Url).Debugf("document incarnation changed from %v to %v", target.lastDocumentIncarnation, scheduledEvents.DocumentIncarnation)
+		scheduledEventDocumentIncarnationChanges.With(targetLabels).Inc()
+		target.documentIncarnationChangeTime = time.Now()
+	}
+	target.lastDocumentIncarnation = scheduledEvents.DocumentIncarnation
+	target.documentIncarnationSeen = true
+	lastSuccessTime = time.Now()
+	target.lastSuccessTime = lastSuccessTime
+	target.lastResponse = scheduledEvents
+	target.lastResponseTime = lastSuccessTime
+	scheduledEventLastScrape.With(targetLabels).Set(float64(lastSuccessTime.Unix()))
+	collectionLock.Unlock()
+
+	scrapeLogger(ctx).WithField("url", target.Url).Debugf("fetched %v Azure ScheduledEvents", len(scheduledEvents.Events))
+
+	// successful scrape, reset systemd watchdog
+	systemdNotify("WATCHDOG=1")
+}
+
+// resets and repopulates event metrics of target, scrapes wait until update is finished
+// so they never see the intermediate (empty) state
+func updateTargetMetrics(ctx context.Context, target *ApiTarget, events []AzureScheduledEvent, staleEventIds map[string]bool) {
+	targetLabels := prometheus.Labels{"target": target.Url}
+
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	scheduledEvent.DeletePartialMatch(targetLabels)
+	scheduledEventInfo.DeletePartialMatch(targetLabels)
+	scheduledEventCount.DeletePartialMatch(targetLabels)
+	scheduledEventStatus.DeletePartialMatch(targetLabels)
+	scheduledEventNotBeforeSeconds.DeletePartialMatch(targetLabels)
+	scheduledEventNotBeforeInfo.DeletePartialMatch(targetLabels)
+	scheduledEventTimeToNextEvent.DeletePartialMatch(targetLabels)
+	scheduledEventImminent.DeletePartialMatch(targetLabels)
+	scheduledEventStale.DeletePartialMatch(targetLabels)
+	scheduledEventAffectsSelf.DeletePartialMatch(targetLabels)
+	scheduledEventNew.DeletePartialMatch(targetLabels)
+	scheduledEventDuration.DeletePartialMatch(targetLabels)
+	scheduledEventResourceCount.DeletePartialMatch(targetLabels)
+
+	// counted EventIds and exported (eventID, resource) pairs, Azure may return redundant entries
+	countedEventIds := map[string]bool{}
+	exportedResources := map[[2]string]bool{}
+	countedResources := map[[2]string]bool{}
+	affectsSelfIds := map[string]bool{}
+	vmName := currentSelfName()
+	eventResourceCount := map[string]float64{}
+
+	// seconds until next upcoming event, events past NotBefore are ignored
+	timeToNextEvent := math.Inf(1)
+
+	// resource types of previous scrapes are kept with 0
+	resourceTypeCount := map[string]float64{}
+	for resourceType := range target.resourceTypes {
+		resourceTypeCount[resourceType] = 0
+	}
+
+	for _, event := range events {
+		scheduledEventInfo.With(prometheus.Labels{"target": target.Url, "eventID": event.EventId, "description": event.Description}).Set(1)
+
+		// same EventId can be listed multiple times (eg. after reschedule)
+		if !countedEventIds[event.EventId] {
+			countedEventIds[event.EventId] = true
+			scheduledEventCount.With(prometheus.Labels{"target": target.Url, "eventType": event.EventType, "eventStatus": event.EventStatus}).Inc()
+		}
+
+		// status as enum, unknown status values are exported additionally
+		for _, status := range appendIfMissing(eventStatusList, event.EventStatus) {
+			statusValue := float64(0)
+			if status == event.EventStatus {
+				statusValue = 1
+			}
+			scheduledEventStatus.With(prometheus.Labels{"target": target.Url, "eventID": event.EventId, "eventStatus": status}).Set(statusValue)
+		}
+
 		eventValue := float64(1)
+		imminentValue := float64(0)
 
 		if event.NotBefore != "" {
+			scheduledEventNotBeforeInfo.With(prometheus.Labels{"target": target.Url, "eventID": event.EventId, "notBefore": event.NotBefore}).Set(1)
+
 			notBefore, err := parseTime(event.NotBefore)
 			if err == nil {
-				eventValue = float64(notBefore.Unix())
+				if opts.EventValueMode == eventValueNotBefore {
+					eventValue = float64(notBefore.Unix())
+				}
+				timeUntil := time.Until(notBefore).Seconds()
+				scheduledEventNotBeforeSeconds.With(prometheus.Labels{"target": target.Url, "eventID": event.EventId}).Set(timeUntil)
+				if timeUntil > 0 && timeUntil < timeToNextEvent {
+					timeToNextEvent = timeUntil
+				}
+				if timeUntil <= 0 {
+					imminentValue = 1
+				}
 			} else {
-				log.Errorf("failed API call: %v", err)
-				log.Errorf("unable to parse time \"%s\" of eventid \"%v\": %v", event.NotBefore, event.EventId, err)
-				eventValue = 0
+				scrapeLogger(ctx).WithFields(log.Fields{
+					"eventId":   event.EventId,
+					"notBefore": event.NotBefore,
+				}).Errorf("unable to parse time \"%s\" of eventid \"%v\": %v", event.NotBefore, event.EventId, err)
+				scheduledEventNotBeforeParseErrors.With(targetLabels).Inc()
+				// NaN, as 0 would be a valid (epoch) timestamp
+				if opts.EventValueMode == eventValueNotBefore {
+					eventValue = math.NaN()
+				}
+			}
+		}
+
+		// -1 (unknown) is passed through as is
+		scheduledEventDuration.With(prometheus.Labels{"target": target.Url, "eventID": event.EventId}).Set(float64(event.DurationInSeconds))
+
+		scheduledEventImminent.With(prometheus.Labels{"target": target.Url, "eventID": event.EventId}).Set(imminentValue)
+
+		staleValue := float64(0)
+		if staleEventIds[event.EventId] {
+			staleValue = 1
+		}
+		scheduledEventStale.With(prometheus.Labels{"target": target.Url, "eventID": event.EventId}).Set(staleValue)
+
+		// only exported if name of this VM is known, EventIds listed multiple times affect this VM if any entry does
+		if vmName != "" {
+			affectsSelfIds[event.EventId] = affectsSelfIds[event.EventId] || eventAffectsSelf(event, vmName)
+			affectsSelfValue := float64(0)
+			if affectsSelfIds[event.EventId] {
+				affectsSelfValue = 1
 			}
+			scheduledEventAffectsSelf.With(prometheus.Labels{"target": target.Url, "eventID": event.EventId}).Set(affectsSelfValue)
 		}
 
-		if len(event.Resources) >= 1 {
-			for _, resource := range event.Resources {
-				scheduledEvent.With(
-					prometheus.Labels{
-						"eventID":      event.EventId,
-						"eventType":    event.EventType,
-						"resourceType": event.ResourceType,
-						"resource":     resource,
-						"eventStatus":  event.EventStatus,
-						"notBefore":    event.NotBefore,
-					}).Set(eventValue)
+		// EventIds of previous scrape are replaced after metrics update
+		newValue := float64(0)
+		if !target.seenEventIds[event.EventId] {
+			newValue = 1
+		}
+		scheduledEventNew.With(prometheus.Labels{"target": target.Url, "eventID": event.EventId}).Set(newValue)
+
+		// older API versions don't provide EventSource
+		eventSource := event.EventSource
+		if eventSource == "" {
+			eventSource = "unknown"
+		}
+
+		resources := event.Resources
+		if len(resources) == 0 {
+			resources = []string{""}
+		}
+
+		// (eventID, resource) pairs by resource type and by EventId, independent of exported labels
+		for _, resource := range resources {
+			resourceKey := [2]string{event.EventId, resource}
+			if !countedResources[resourceKey] {
+				countedResources[resourceKey] = true
+				resourceTypeCount[event.ResourceType]++
+				if resource != "" {
+					eventResourceCount[event.EventId]++
+				}
 			}
-		} else {
-			scheduledEvent.With(
-				prometheus.Labels{
-					"eventID":      event.EventId,
-					"eventType":    event.EventType,
-					"resourceType": event.ResourceType,
-					"resource":     "",
-					"eventStatus":  event.EventStatus,
-					"notBefore":    event.NotBefore,
-				}).Set(eventValue)
 		}
+		scheduledEventResourceCount.With(prometheus.Labels{"target": target.Url, "eventID": event.EventId}).Set(eventResourceCount[event.EventId])
+
+		// without resource label (--metrics-labelset=minimal) events are exported once
+		if opts.LabelSet == labelSetMinimal {
+			resources = []string{""}
+		}
+
+		for _, resource := range resources {
+			resourceKey := [2]string{event.EventId, resource}
+			if exportedResources[resourceKey] {
+				scrapeLogger(ctx).WithFields(log.Fields{
+					"url":      target.Url,
+					"eventId":  event.EventId,
+					"resource": resource,
+				}).Warnf("skipping duplicate resource \"%v\" of eventid \"%v\"", resource, event.EventId)
+				continue
+			}
+			exportedResources[resourceKey] = true
+
+			eventLabels := map[string]string{
+				"target":       target.Url,
+				"eventID":      event.EventId,
+				"eventType":    event.EventType,
+				"resourceType": event.ResourceType,
+				"resource":     resource,
+				"eventStatus":  event.EventStatus,
+				"eventSource":  eventSource,
+				"description":  event.Description,
+				"duration":     strconv.Itoa(event.DurationInSeconds),
+				"notBefore":    event.NotBefore,
+			}
+
+			// only labels of --metrics-labelset (and notBefore if enabled)
+			labels := prometheus.Labels{}
+			for _, name := range scheduledEventLabels {
+				labels[name] = eventLabels[name]
+			}
+
+			scheduledEvent.With(labels).Set(eventValue)
+		}
+	}
+
+	if !math.IsInf(timeToNextEvent, 1) {
+		scheduledEventTimeToNextEvent.With(targetLabels).Set(timeToNextEvent)
 	}
 
-	scheduledEventDocumentIncarnation.With(prometheus.Labels{}).Set(float64(scheduledEvents.DocumentIncarnation))
+	target.resourceTypes = map[string]bool{}
+	for resourceType, count := range resourceTypeCount {
+		target.resourceTypes[resourceType] = true
+		scheduledEventResourceTypeCount.With(prometheus.Labels{"target": target.Url, "resourceType": resourceType}).Set(count)
+	}
 
-	log.Debugf("fetched %v Azure ScheduledEvents", len(scheduledEvents.Events))
+	checkTargetMetrics(ctx, target, events)
 }
 
-func fetchApiUrl() (*AzureScheduledEventResponse, error) {
-	ret := &AzureScheduledEventResponse{}
+// self-diagnostic: checks if exported azure_scheduledevent_event series match event list, must be called with metricsLock
+func checkTargetMetrics(ctx context.Context, target *ApiTarget, events []AzureScheduledEvent) {
+	// expected series: unique (eventID, resource) pairs, events without resources (or resource label) are exported once
+	expectedSeries := map[[2]string]bool{}
+	for _, event := range events {
+		if len(event.Resources) == 0 || opts.LabelSet == labelSetMinimal {
+			expectedSeries[[2]string{event.EventId, ""}] = true
+			continue
+		}
+		for _, resource := range event.Resources {
+			expectedSeries[[2]string{event.EventId, resource}] = true
+		}
+	}
 
-	startTime := time.Now()
-	req, err := http.NewRequest("GET", opts.ApiUrl, nil)
-	if err != nil {
-		scheduledEventRequestError.With(prometheus.Labels{}).Inc()
-		return nil, err
+	// initialized with 0 so it can be used in alerts
+	inconsistencyCounter := scheduledEventInternalInconsistency.With(prometheus.Labels{"target": target.Url})
+
+	exportedSeries := countTargetSeries(scheduledEvent, target.Url)
+	if exportedSeries != len(expectedSeries) {
+		scrapeLogger(ctx).WithFields(log.Fields{
+			"url":      target.Url,
+			"expected": len(expectedSeries),
+			"exported": exportedSeries,
+			"events":   len(events),
+		}).Errorf("internal inconsistency: exported %v azure_scheduledevent_event series, expected %v", exportedSeries, len(expectedSeries))
+		inconsistencyCounter.Inc()
 	}
-	req.Header.Add("Metadata", "true")
+}
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		scheduledEventRequestError.With(prometheus.Labels{}).Inc()
-		return nil, err
+// counts series of collector with target label
+func countTargetSeries(collector prometheus.Collector, target string) int {
+	count := 0
+	for _, metric := range collectSeries(collector) {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "target" && label.GetValue() == target {
+				count++
+				break
+			}
+		}
 	}
-	defer resp.Body.Close()
+	return count
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&ret)
-	if err != nil {
-		scheduledEventRequestError.With(prometheus.Labels{}).Inc()
-		return nil, err
+// returns current series of collector
+func collectSeries(collector prometheus.Collector) []*dto.Metric {
+	metricChan := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(metricChan)
+		close(metricChan)
+	}()
+
+	ret := []*dto.Metric{}
+	for metric := range metricChan {
+		metricDto := &dto.Metric{}
+		if err := metric.Write(metricDto); err != nil {
+			continue
+		}
+		ret = append(ret, metricDto)
+	}
+	return ret
+}
+
+// checks expected fields of event (missing depending on API version), missing fields are replaced by "unknown"
+// (--on-missing-field=placeholder) or event is skipped (--on-missing-field=skip, always if EventId is missing)
+func handleMissingFields(ctx context.Context, target *ApiTarget, event AzureScheduledEvent) (AzureScheduledEvent, bool) {
+	eventLogger := scrapeLogger(ctx).WithFields(log.Fields{
+		"url":     target.Url,
+		"eventId": event.EventId,
+	})
+
+	if event.EventId == "" {
+		eventLogger.Warn("skipping event without EventId")
+		scheduledEventMissingFieldSkipped.With(prometheus.Labels{"target": target.Url, "field": "EventId"}).Inc()
+		return event, false
+	}
+
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"EventType", &event.EventType},
+		{"ResourceType", &event.ResourceType},
+		{"EventStatus", &event.EventStatus},
 	}
+	for _, field := range fields {
+		if strings.TrimSpace(*field.value) != "" {
+			continue
+		}
+
+		if opts.OnMissingField == "skip" {
+			eventLogger.Warnf("skipping event \"%v\", field %v is missing", event.EventId, field.name)
+			scheduledEventMissingFieldSkipped.With(prometheus.Labels{"target": target.Url, "field": field.name}).Inc()
+			return event, false
+		}
 
-	if opts.MetricsRequestStats {
-		duration := time.Since(startTime)
-		scheduledEventRequest.With(prometheus.Labels{}).Observe(duration.Seconds())
+		eventLogger.Debugf("field %v of event \"%v\" is missing, using \"unknown\"", field.name, event.EventId)
+		*field.value = "unknown"
 	}
 
-	return ret, nil
+	return event, true
 }
 
-func parseTime(value string) (parsedTime time.Time, err error) {
-	for _, format := range timeFormatList {
-		parsedTime, err = time.Parse(format, value)
-		if err == nil {
-			break
+// normalizes resource names by --resource-name-mode (short: last segment of resource id without domain,
+// fqdn-strip: without domain), returns copy without duplicates
+func normalizeResourceNames(resources []string) []string {
+	if opts.ResourceNameMode == "asis" {
+		return resources
+	}
+
+	// names can be equal after normalization
+	seen := map[string]bool{}
+	ret := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		if opts.ResourceNameMode == "short" {
+			resource = strings.TrimRight(resource, "/")
+			resource = resource[strings.LastIndex(resource, "/")+1:]
+		}
+
+		// FQDN (eg. vm1.internal.cloudapp.net), resource ids are kept
+		if !strings.Contains(resource, "/") {
+			if i := strings.Index(resource, "."); i > 0 {
+				resource = resource[:i]
+			}
+		}
+
+		if !seen[resource] {
+			seen[resource] = true
+			ret = append(ret, resource)
+		}
+	}
+	return ret
+}
+
+// checks event type against include and exclude filter
+// precedence: included types are always allowed, excluded types are dropped,
+// others are dropped only if an include filter is set
+func eventTypeAllowed(eventType string) bool {
+	for _, val := range opts.EventTypeInclude {
+		if strings.EqualFold(val, eventType) {
+			return true
+		}
+	}
+
+	for _, val := range opts.EventTypeExclude {
+		if strings.EqualFold(val, eventType) {
+			return false
+		}
+	}
+
+	return len(opts.EventTypeInclude) == 0
+}
+
+// returns copy of list with value appended if not already contained
+func appendIfMissing(list []string, value string) []string {
+	ret := append([]string{}, list...)
+	for _, item := range list {
+		if item == value {
+			return ret
+		}
+	}
+	return append(ret, value)
+}
+
+// --event-retention: keeps events which disappeared from API response (eg. during reschedule) for retention period,
+// returns retained (stale) events and their EventIds
+func retainEvents(target *ApiTarget, events []AzureScheduledEvent) ([]AzureScheduledEvent, map[string]bool) {
+	staleEvents := []AzureScheduledEvent{}
+	staleEventIds := map[string]bool{}
+	if opts.EventRetention <= 0 {
+		target.retainedEvents = nil
+		return staleEvents, staleEventIds
+	}
+
+	now := time.Now()
+	retainedEvents := map[string]*retainedEvent{}
+	for _, event := range events {
+		retained, ok := retainedEvents[event.EventId]
+		if !ok {
+			retained = &retainedEvent{lastSeen: now}
+			retainedEvents[event.EventId] = retained
+		}
+		retained.events = append(retained.events, event)
+	}
+
+	for eventId, retained := range target.retainedEvents {
+		if retainedEvents[eventId] != nil || now.Sub(retained.lastSeen) > opts.EventRetention {
+			continue
 		}
+		retainedEvents[eventId] = retained
+		staleEvents = append(staleEvents, retained.events...)
+		staleEventIds[eventId] = true
 	}
 
-	return
+	target.retainedEvents = retainedEvents
+	return staleEvents, staleEventIds
 }
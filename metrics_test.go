@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateTargetMetricsDuplicateResources(t *testing.T) {
+	setupTestOptions(t)
+	target := apiTargets[0]
+
+	events := []AzureScheduledEvent{
+		{EventId: "event1", EventType: "Reboot", ResourceType: "VirtualMachine", EventStatus: "Scheduled", Resources: []string{"vm1", "vm1", "vm2"}},
+		// same EventId listed twice
+		{EventId: "event1", EventType: "Reboot", ResourceType: "VirtualMachine", EventStatus: "Scheduled", Resources: []string{"vm2"}},
+		{EventId: "event2", EventType: "Freeze", ResourceType: "VirtualMachine", EventStatus: "Scheduled"},
+	}
+	updateTargetMetrics(context.Background(), target, events, nil)
+
+	expectedResourceCount := map[string]float64{"event1": 2, "event2": 0}
+	for eventId, expected := range expectedResourceCount {
+		resourceCount := testutil.ToFloat64(scheduledEventResourceCount.With(prometheus.Labels{"target": target.Url, "eventID": eventId}))
+		if resourceCount != expected {
+			t.Errorf("event %v: expected resource count %v, got %v", eventId, expected, resourceCount)
+		}
+	}
+
+	// one series per unique (eventID, resource) pair
+	if series := countTargetSeries(scheduledEvent, target.Url); series != 3 {
+		t.Errorf("expected 3 azure_scheduledevent_event series, got %v", series)
+	}
+}
+
+func TestUpdateTargetMetricsConcurrentScrape(t *testing.T) {
+	setupTestOptions(t)
+	target := apiTargets[0]
+
+	events := []AzureScheduledEvent{
+		{EventId: "event1", EventType: "Reboot", ResourceType: "VirtualMachine", EventStatus: "Scheduled", Resources: []string{"vm1", "vm2"}},
+		{EventId: "event2", EventType: "Freeze", ResourceType: "VirtualMachine", EventStatus: "Scheduled", Resources: []string{"vm3"}},
+	}
+	updateTargetMetrics(context.Background(), target, events, nil)
+
+	// scrapes through ScheduledEventsCollector (without go and process collectors of metricsRegistry)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewScheduledEventsCollector(context.Background(), scheduledEvent))
+
+	// run updates and scrapes in parallel (also on single cpu machines)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	// collections reset and repopulate the event metrics, scrapes must never see the intermediate state
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for deadline := time.Now().Add(250 * time.Millisecond); time.Now().Before(deadline); {
+			updateTargetMetrics(context.Background(), target, events, nil)
+			runtime.Gosched()
+		}
+	}()
+
+	for scrape := 0; ; scrape++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if series := countGatheredTargetSeries(t, registry, target.Url); series != 3 {
+			t.Fatalf("scrape %v: expected 3 azure_scheduledevent_event series, got %v", scrape, series)
+		}
+	}
+}
+
+func TestProbeTargetEmptyBody(t *testing.T) {
+	setupTestOptions(t, "--api-retry-count=0")
+	newImdsTestServer(t,
+		imdsTestResponse{status: http.StatusOK, body: imdsTestEventsBody},
+		imdsTestResponse{status: http.StatusOK, body: ""},
+		imdsTestResponse{status: http.StatusNoContent},
+	)
+	target := apiTargets[0]
+
+	probeTarget(context.Background(), context.Background(), target)
+	if series := countTargetSeries(scheduledEvent, target.Url); series != 1 {
+		t.Fatalf("expected 1 azure_scheduledevent_event series, got %v", series)
+	}
+
+	// empty body (ScheduledEvents service initializing) is a successful API call without events
+	for _, response := range []string{"empty body", "no content"} {
+		probeTarget(context.Background(), context.Background(), target)
+
+		if up := testutil.ToFloat64(scheduledEventUp.With(prometheus.Labels{"target": target.Url})); up != 1 {
+			t.Errorf("%v: expected azure_scheduledevents_up 1, got %v", response, up)
+		}
+		if series := countTargetSeries(scheduledEvent, target.Url); series != 0 {
+			t.Errorf("%v: expected no azure_scheduledevent_event series, got %v", response, series)
+		}
+		if errors := countTargetSeries(scheduledEventApiErrors, target.Url); errors != 0 {
+			t.Errorf("%v: expected no API errors, got %v series", response, errors)
+		}
+	}
+}
+
+func TestStartMetricsCollectionCancel(t *testing.T) {
+	setupTestOptions(t, "--no-startup-jitter", "--api-retry-count=0", "--api-timeout=5s")
+	server := newImdsTestServer(t, imdsTestResponse{status: http.StatusOK, body: imdsTestEventsBody, delay: 500 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := startMetricsCollection(ctx)
+
+	// cancel while first probe is running
+	for deadline := time.Now().Add(2 * time.Second); server.Requests() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("background collection didn't call API")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("background collection didn't stop within 2s after context was cancelled")
+	}
+}
+
+func TestMetricsRegistryIsolated(t *testing.T) {
+	setupTestOptions(t)
+	newImdsTestServer(t)
+	probeCollect(context.Background())
+
+	// returns names of gathered azure_ metric families
+	azureMetrics := func(gatherer prometheus.Gatherer) map[string]bool {
+		families, err := gatherer.Gather()
+		if err != nil {
+			t.Fatalf("unable to gather metrics: %v", err)
+		}
+
+		ret := map[string]bool{}
+		for _, family := range families {
+			if strings.HasPrefix(family.GetName(), "azure_") {
+				ret[family.GetName()] = true
+			}
+		}
+		return ret
+	}
+
+	registryMetrics := azureMetrics(metricsRegistry)
+	for _, name := range []string{"azure_scheduledevents_up", "azure_scheduledevent_event", "azure_scheduledevent_document_incarnation"} {
+		if !registryMetrics[name] {
+			t.Errorf("expected %v in metrics registry", name)
+		}
+	}
+
+	if defaultMetrics := azureMetrics(prometheus.DefaultGatherer); len(defaultMetrics) != 0 {
+		t.Errorf("expected no azure_ metrics in default registry, got %v", defaultMetrics)
+	}
+	if newMetrics := azureMetrics(NewMetricsRegistry()); len(newMetrics) != 0 {
+		t.Errorf("expected no azure_ metrics in new registry, got %v", newMetrics)
+	}
+}
+
+func TestProbeCollectScrapeDurationExemplar(t *testing.T) {
+	setupTestOptions(t)
+	newImdsTestServer(t)
+	probeCollect(context.WithValue(context.Background(), scrapeIdKey{}, "0000cafe"))
+
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "azure_scheduledevents_scrape_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, bucket := range metric.GetHistogram().GetBucket() {
+				for _, label := range bucket.GetExemplar().GetLabel() {
+					if label.GetName() == "scrape_id" && label.GetValue() == "0000cafe" {
+						return
+					}
+				}
+			}
+		}
+	}
+	t.Error("expected azure_scheduledevents_scrape_duration_seconds exemplar with scrape_id of scrape")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+var (
+	// options which can be changed by config reload (SIGHUP)
+	// metrics are only registered once at startup (setupMetricsCollection) and are never re-registered
+	// by reload, so options affecting metric names or labels must not be reloadable
+	reloadableOptions = map[string]bool{
+		"Logger.LogLevel":       true,
+		"ScrapeTime":            true,
+		"ScrapeTimeout":         true,
+		"ApiTimeout":            true,
+		"ApiErrorThreshold":     true,
+		"ApiErrorWindow":        true,
+		"ApiErrorBehavior":      true,
+		"ApiRetryCount":         true,
+		"ApiRetryDelay":         true,
+		"EventTypeInclude":      true,
+		"EventTypeExclude":      true,
+		"OnMissingField":        true,
+		"EventRetention":        true,
+		"AutoApproveEventTypes": true,
+		"AutoApproveStatuses":   true,
+		"ApproveDryRun":         true,
+	}
+)
+
+func startConfigReload(ctx context.Context) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(signalChan)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signalChan:
+				reloadConfig()
+			}
+		}
+	}()
+}
+
+func reloadConfig() {
+	if opts.ConfigFile == "" {
+		log.Warn("received SIGHUP but no config file is configured, nothing to reload")
+		return
+	}
+
+	log.Infof("received SIGHUP, reloading config file \"%v\"", opts.ConfigFile)
+	_, reloadedOpts, err := parseOptions(os.Args[1:])
+	if err != nil {
+		log.Errorf("failed to reload config, keeping current config: %v", err)
+		return
+	}
+	applyOptionDefaults(reloadedOpts)
+	if err := validateOptions(reloadedOpts); err != nil {
+		log.Errorf("invalid config, keeping current config: %v", err)
+		return
+	}
+
+	// wait for running scrape and block collection while options are swapped
+	// (only option values are swapped, collectors and existing series are kept)
+	probeLock.Lock()
+	defer probeLock.Unlock()
+	collectionLock.Lock()
+	defer collectionLock.Unlock()
+
+	if reloadOptions(reflect.ValueOf(&opts).Elem(), reflect.ValueOf(reloadedOpts).Elem(), "") {
+		initLogLevel()
+	} else {
+		log.Info("no reloadable options changed")
+	}
+}
+
+// applies changed reloadable options from reloaded to current, returns true if any option was changed
+func reloadOptions(current, reloaded reflect.Value, prefix string) (changed bool) {
+	for i := 0; i < current.NumField(); i++ {
+		field := current.Type().Field(i)
+		name := prefix + field.Name
+
+		if field.Type.Kind() == reflect.Struct {
+			changed = reloadOptions(current.Field(i), reloaded.Field(i), name+".") || changed
+			continue
+		}
+
+		currentValue := current.Field(i).Interface()
+		reloadedValue := reloaded.Field(i).Interface()
+		if reflect.DeepEqual(currentValue, reloadedValue) {
+			continue
+		}
+
+		if !reloadableOptions[name] {
+			log.Warnf("option %v changed, requires restart", name)
+			continue
+		}
+
+		// don't log secrets (excluded from json dump)
+		if field.Tag.Get("json") == "-" {
+			log.Infof("option %v changed", name)
+		} else {
+			log.Infof("option %v changed from %v to %v", name, currentValue, reloadedValue)
+		}
+
+		current.Field(i).Set(reloaded.Field(i))
+		changed = true
+	}
+
+	return
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writes yaml config file for IMDS test server with scrape time
+func writeTestConfigFile(t *testing.T, path, apiUrl string, scrapeTime time.Duration) {
+	t.Helper()
+	content := fmt.Sprintf("log.level: warn\napi-url: %q\nno-startup-jitter: true\nscrape-time: %v\n", apiUrl, scrapeTime)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unable to write config file: %v", err)
+	}
+}
+
+func TestReloadConfigConcurrentScrape(t *testing.T) {
+	setupTestOptions(t)
+	server := newImdsTestServer(t)
+	apiUrl := server.URL + apiDefaultPath
+
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfigFile(t, configFile, apiUrl, time.Minute)
+
+	// reload parses command line again
+	args := os.Args
+	os.Args = []string{"azure-scheduledevents-exporter", "--config=" + configFile}
+	defer func() { os.Args = args }()
+
+	setupTestOptions(t, os.Args[1:]...)
+	target := apiTargets[0]
+	runProbeCollect(context.Background())
+	if series := countTargetSeries(scheduledEvent, target.Url); series != 1 {
+		t.Fatalf("expected 1 azure_scheduledevent_event series before reload, got %v", series)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startConfigReload(ctx)
+
+	// scrapes and collection are running during reloads, collectors must not be re-registered
+	// and existing series must be kept
+	errs := make(chan error, 2)
+	go func() {
+		for ctx.Err() == nil {
+			if series := countGatheredTargetSeries(t, metricsRegistry, target.Url); series != 1 {
+				errs <- fmt.Errorf("expected 1 azure_scheduledevent_event series during reload, got %v", series)
+				return
+			}
+		}
+		errs <- nil
+	}()
+	go func() {
+		for ctx.Err() == nil {
+			runProbeCollect(ctx)
+			time.Sleep(time.Millisecond)
+		}
+		errs <- nil
+	}()
+
+	for i := 1; i <= 10; i++ {
+		scrapeTime := time.Minute + time.Duration(i)*time.Second
+		writeTestConfigFile(t, configFile, apiUrl, scrapeTime)
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatalf("unable to send SIGHUP: %v", err)
+		}
+
+		for deadline := time.Now().Add(2 * time.Second); currentScrapeTime() != scrapeTime; {
+			if time.Now().After(deadline) {
+				t.Fatalf("reload %v: scrape time %v wasn't reloaded (current: %v)", i, scrapeTime, currentScrapeTime())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if series := countTargetSeries(scheduledEvent, target.Url); series != 1 {
+		t.Errorf("expected 1 azure_scheduledevent_event series after reload, got %v", series)
+	}
+}
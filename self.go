@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// backoff of compute name detection retries (doubled after every failed attempt)
+	selfNameRetryMinDelay = 5 * time.Second
+	selfNameRetryMaxDelay = 5 * time.Minute
+)
+
+var (
+	// name of this VM for azure_scheduledevent_affects_self (empty until known)
+	selfName     string
+	selfNameLock sync.RWMutex
+)
+
+// sets selfName from --self-name or detects compute name of Azure instance metadata in background (startup and
+// http server aren't delayed by unreachable IMDS), failed detection is logged once and retried with exponential
+// backoff until successful
+func startSelfNameDetection(ctx context.Context) {
+	if opts.SelfName != "" {
+		setSelfName(opts.SelfName)
+		return
+	}
+
+	// --dev.api-mock-file: there is no Azure instance metadata
+	if opts.ApiMockFile != "" {
+		log.Warn("mock file: compute name is not detected, set --self-name for azure_scheduledevent_affects_self")
+		return
+	}
+
+	go func() {
+		delay := selfNameRetryMinDelay
+		for attempt := 1; ; attempt++ {
+			name, err := fetchComputeName(ctx)
+			if err == nil {
+				log.Infof("detected compute name \"%v\" via IMDS instance metadata", name)
+				setSelfName(name)
+				return
+			} else if ctx.Err() != nil {
+				return
+			}
+
+			if attempt == 1 {
+				log.Warnf("failed to detect compute name via IMDS instance metadata, retrying in background (azure_scheduledevent_affects_self is not exported until detected, see --self-name): %v", err)
+			} else {
+				log.Debugf("failed to detect compute name via IMDS instance metadata, retrying in %v: %v", delay, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			delay *= 2
+			if delay > selfNameRetryMaxDelay {
+				delay = selfNameRetryMaxDelay
+			}
+		}
+	}()
+}
+
+// returns name of this VM (empty if not known yet)
+func currentSelfName() string {
+	selfNameLock.RLock()
+	defer selfNameLock.RUnlock()
+	return selfName
+}
+
+func setSelfName(name string) {
+	selfNameLock.Lock()
+	defer selfNameLock.Unlock()
+	selfName = name
+}
+
+// checks if VM (name) is one of the resources of event, resource ids and FQDNs are compared by name
+func eventAffectsSelf(event AzureScheduledEvent, name string) bool {
+	for _, resource := range event.Resources {
+		if strings.EqualFold(shortResourceName(resource), shortResourceName(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns last segment of resource id without domain
+func shortResourceName(resource string) string {
+	resource = strings.TrimRight(resource, "/")
+	resource = resource[strings.LastIndex(resource, "/")+1:]
+	if i := strings.Index(resource, "."); i > 0 {
+		resource = resource[:i]
+	}
+	return resource
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// starts IMDS test server for compute name (and scheduled events) and points --api-url (and API target) at it
+func newComputeNameTestServer(t *testing.T, status int, name string, delay time.Duration) *int32 {
+	t.Helper()
+	requests := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		switch {
+		case r.Header.Get("Metadata") != "true":
+			w.WriteHeader(http.StatusBadRequest)
+		case r.URL.Path == azureInstanceMetadataPath+"/compute/name":
+			time.Sleep(delay)
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(name))
+		default:
+			_, _ = w.Write([]byte(imdsTestEventsBody))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	opts.ApiUrl = []string{server.URL + apiDefaultPath}
+	apiTargets = []*ApiTarget{{Url: opts.ApiUrl[0]}}
+	return requests
+}
+
+func TestStartSelfNameDetection(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		status   int
+		delay    time.Duration
+		expected string
+		requests int32
+	}{
+		{name: "detected", status: http.StatusOK, expected: "VM1", requests: 1},
+		{name: "slow", status: http.StatusOK, delay: 500 * time.Millisecond, expected: "VM1", requests: 1},
+		{name: "self-name", args: []string{"--self-name=vm2"}, status: http.StatusOK, expected: "vm2"},
+		{name: "mock file", args: []string{"--dev.api-mock-file=examples/events.json"}, status: http.StatusOK},
+		{name: "failed", status: http.StatusInternalServerError, requests: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestOptions(t, append([]string{"--api-retry-count=0"}, test.args...)...)
+			requests := newComputeNameTestServer(t, test.status, "VM1\n", test.delay)
+			setSelfName("")
+			defer setSelfName("")
+
+			// background retry of failed detection is stopped by cancelled context
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// detected in background, startup isn't delayed by IMDS
+			startTime := time.Now()
+			startSelfNameDetection(ctx)
+			if duration := time.Since(startTime); duration > 100*time.Millisecond {
+				t.Errorf("expected detection in background, startup was blocked for %v", duration)
+			}
+
+			for deadline := time.Now().Add(2 * time.Second); atomic.LoadInt32(requests) < test.requests || currentSelfName() != test.expected; {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected self name %q after %v instance metadata requests, got %q after %v", test.expected, test.requests, currentSelfName(), atomic.LoadInt32(requests))
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if count := atomic.LoadInt32(requests); count != test.requests {
+				t.Errorf("expected %v instance metadata requests, got %v", test.requests, count)
+			}
+
+			// probes don't detect compute name (mock file: no API request)
+			probeCollect(ctx)
+			if count := atomic.LoadInt32(requests); opts.ApiMockFile == "" && count != test.requests+1 {
+				t.Errorf("expected only scheduled events request by probe, got %v requests", count-test.requests)
+			}
+		})
+	}
+}
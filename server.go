@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"html"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+const (
+	landingPageTemplate = `<html>
+<head><title>Azure ScheduledEvents Exporter</title></head>
+<body>
+<h1>Azure ScheduledEvents Exporter</h1>
+<p><a href="%s">%s</a></p>
+</body>
+</html>
+`
+)
+
+// serves metricsRegistry, OpenMetrics format (required for exemplars) if requested by Accept header,
+// Prometheus text format otherwise
+func metricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(
+		metricsRegistry,
+		promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+	)
+}
+
+func startHttpServer(ctx context.Context) {
+	// dedicated mux, pprof registers its handlers on http.DefaultServeMux
+	mux := http.NewServeMux()
+
+	// healthz (liveness, independent of Azure API status)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := fmt.Fprint(w, `{"status":"ok"}`); err != nil {
+			log.Error(err)
+		}
+	})
+
+	// readyz (readiness, requires recent successful scrape)
+	mux.HandleFunc("/readyz", handleReadyz)
+
+	// landing page
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		metricsPath := html.EscapeString(opts.MetricsPath)
+		if _, err := fmt.Fprintf(w, landingPageTemplate, metricsPath, metricsPath); err != nil {
+			log.Error(err)
+		}
+	})
+
+	mux.Handle(opts.MetricsPath, basicAuthHandler(metricsHandler()))
+
+	// API response of last successful API call (protected by basic auth if set)
+	mux.Handle("/events", basicAuthHandler(http.HandlerFunc(handleEvents)))
+
+	// InfluxDB line protocol (protected by basic auth if set)
+	if opts.EnableInflux {
+		log.Infof("enabling InfluxDB line protocol endpoint on /influx")
+		mux.Handle("/influx", basicAuthHandler(handleInflux(ctx)))
+	}
+
+	// pprof (protected by basic auth if set)
+	if opts.EnablePprof {
+		log.Infof("enabling pprof endpoints on /debug/pprof/")
+		mux.Handle("/debug/pprof/", basicAuthHandler(http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", basicAuthHandler(http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", basicAuthHandler(http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", basicAuthHandler(http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", basicAuthHandler(http.HandlerFunc(pprof.Trace)))
+	}
+
+	server := &http.Server{Addr: opts.ServerBind, Handler: mux}
+
+	// graceful shutdown
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+
+		log.Infof("shutting down http server (grace period %v)", opts.ServerShutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.ServerShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("failed graceful shutdown of http server: %v", err)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", opts.ServerBind)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// server is bound, notify systemd
+	systemdNotify("READY=1")
+
+	if opts.TlsCertFile != "" && opts.TlsKeyFile != "" {
+		log.Infof("serving metrics via https")
+		err = server.ServeTLS(listener, opts.TlsCertFile, opts.TlsKeyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-shutdownDone
+}
+
+// enforces basic auth if username or password is configured
+func basicAuthHandler(next http.Handler) http.Handler {
+	if opts.BasicAuthUsername == "" && opts.BasicAuthPassword == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(opts.BasicAuthUsername)) == 1
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(opts.BasicAuthPassword)) == 1
+
+		if !ok || !usernameMatch || !passwordMatch {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	collectionLock.RLock()
+	lastSuccess := lastSuccessTime
+	maxAge := 2 * opts.ScrapeTime
+	collectionLock.RUnlock()
+
+	response := struct {
+		Status      string     `json:"status"`
+		Message     string     `json:"message,omitempty"`
+		LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	}{
+		Status: "ok",
+	}
+
+	statusCode := http.StatusOK
+	if !lastSuccess.IsZero() {
+		response.LastSuccess = &lastSuccess
+	}
+
+	if lastSuccess.IsZero() {
+		statusCode = http.StatusServiceUnavailable
+		response.Status = "not ready"
+		response.Message = "no successful scrape yet"
+	} else if age := time.Since(lastSuccess); age > maxAge {
+		statusCode = http.StatusServiceUnavailable
+		response.Status = "not ready"
+		response.Message = fmt.Sprintf("last successful scrape %v ago (max %v)", age.Round(time.Second), maxAge)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Error(err)
+	}
+}
+
+// serves unfiltered API responses of last successful API call per target
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	type targetEvents struct {
+		Target    string                       `json:"target"`
+		FetchedAt time.Time                    `json:"fetchedAt"`
+		Response  *AzureScheduledEventResponse `json:"response"`
+	}
+
+	response := []targetEvents{}
+	collectionLock.RLock()
+	for _, target := range apiTargets {
+		if target.lastResponse != nil {
+			response = append(response, targetEvents{
+				Target:    target.Url,
+				FetchedAt: target.lastResponseTime,
+				Response:  target.lastResponse,
+			})
+		}
+	}
+	collectionLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(response) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if _, err := fmt.Fprint(w, `{"status":"no successful API call yet"}`); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Error(err)
+	}
+}
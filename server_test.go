@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandlerContentType(t *testing.T) {
+	setupTestOptions(t)
+	newImdsTestServer(t)
+	probeCollect(context.Background())
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		eof         bool
+	}{
+		{name: "default", contentType: "text/plain; version=0.0.4"},
+		{name: "text", accept: "text/plain", contentType: "text/plain; version=0.0.4"},
+		{name: "openmetrics", accept: "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", contentType: "application/openmetrics-text; version=0.0.1", eof: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			recorder := httptest.NewRecorder()
+			metricsHandler().ServeHTTP(recorder, req)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %v", recorder.Code)
+			}
+			if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, test.contentType) {
+				t.Errorf("expected content type %q, got %q", test.contentType, contentType)
+			}
+
+			body, _ := ioutil.ReadAll(recorder.Body)
+			if !strings.Contains(string(body), "azure_scheduledevents_up{") {
+				t.Error("expected azure_scheduledevents_up in response")
+			}
+			// OpenMetrics responses are terminated by EOF marker
+			if eof := strings.HasSuffix(string(body), "# EOF\n"); eof != test.eof {
+				t.Errorf("expected EOF marker %v, got %v", test.eof, eof)
+			}
+		})
+	}
+}
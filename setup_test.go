@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+var (
+	// metrics are registered once per test binary (registering collectors twice panics)
+	testMetricsOnce sync.Once
+
+	// HTTP_PROXY of test binary (proxy env is read once per process, loopback hosts are never proxied)
+	testProxy         *httptest.Server
+	testProxyLock     sync.Mutex
+	testProxyRequests []string
+)
+
+func TestMain(m *testing.M) {
+	testProxy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testProxyLock.Lock()
+		testProxyRequests = append(testProxyRequests, r.URL.String())
+		testProxyLock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(imdsTestEventsBody))
+	}))
+
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "NO_PROXY", "no_proxy", "REQUEST_METHOD"} {
+		os.Unsetenv(name)
+	}
+	os.Setenv("HTTP_PROXY", testProxy.URL)
+
+	code := m.Run()
+	testProxy.Close()
+	os.Exit(code)
+}
+
+// returns URLs requested via test proxy
+func testProxyRequestList() []string {
+	testProxyLock.Lock()
+	defer testProxyLock.Unlock()
+	return append([]string{}, testProxyRequests...)
+}
+
+// sets options to defaults (plus args) and single API target, registers metrics on first call
+func setupTestOptions(t *testing.T, args ...string) {
+	t.Helper()
+
+	_, parsedOpts, err := parseOptions(args)
+	if err != nil {
+		t.Fatalf("unable to parse options %v: %v", args, err)
+	}
+	applyOptionDefaults(parsedOpts)
+	if err := validateOptions(parsedOpts); err != nil {
+		t.Fatalf("invalid options %v: %v", args, err)
+	}
+	opts = *parsedOpts
+
+	testMetricsOnce.Do(func() {
+		log.SetLevel(log.WarnLevel)
+		setupMetricsCollection(context.Background())
+	})
+	setupHttpClient()
+
+	apiTargets = []*ApiTarget{{Url: opts.ApiUrl[0]}}
+}
+
+// counts azure_scheduledevent_event series of target in gathered registry
+func countGatheredTargetSeries(t *testing.T, gatherer prometheus.Gatherer, target string) int {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather metrics: %v", err)
+	}
+
+	count := 0
+	for _, family := range families {
+		if family.GetName() != "azure_scheduledevent_event" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "target" && label.GetValue() == target {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+)
+
+// sends state notification to systemd (sd_notify), no-op if not running as systemd notify service
+func systemdNotify(state string) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return
+	}
+
+	// abstract sockets (prefixed with @) are handled by net package
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		log.Warnf("failed to notify systemd (%v): %v", state, err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Warnf("failed to notify systemd (%v): %v", state, err)
+	}
+}
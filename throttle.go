@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+var (
+	// --action-max-concurrent, slots of running side-effecting actions (nil if unlimited)
+	actionSlots chan struct{}
+)
+
+func setupActionThrottle() {
+	if opts.ActionMaxConcurrent > 0 {
+		actionSlots = make(chan struct{}, opts.ActionMaxConcurrent)
+	}
+}
+
+// random delay before side-effecting action (0 if --action-throttle is disabled)
+func actionThrottleDelay() time.Duration {
+	if opts.ActionThrottle <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(opts.ActionThrottle)))
+}
+
+// waits for jittered delay and free action slot (async actions: on-event command, webhook),
+// returned function releases the slot
+func acquireAction(ctx context.Context) (func(), error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(actionThrottleDelay()):
+	}
+
+	if actionSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case actionSlots <- struct{}{}:
+		return func() { <-actionSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquires action slot without waiting (actions of probe: approve, cordon), false if all slots are in use
+// as collection must not be blocked
+func tryAcquireAction() (func(), bool) {
+	if actionSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case actionSlots <- struct{}{}:
+		return func() { <-actionSlots }, true
+	default:
+		return nil, false
+	}
+}
+
+// checks if action of probe is due, zero dueTime is set to jittered delay (action is postponed to later scrapes
+// instead of waiting in probe)
+func actionDue(dueTime *time.Time) bool {
+	if dueTime.IsZero() {
+		*dueTime = time.Now().Add(actionThrottleDelay())
+	}
+	return !time.Now().Before(*dueTime)
+}
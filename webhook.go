@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+type (
+	AzureScheduledEventWebhook struct {
+		Target string                    `json:"target"`
+		Time   time.Time                 `json:"time"`
+		Events []AzureScheduledEventHook `json:"events"`
+	}
+
+	AzureScheduledEventHook struct {
+		EventId      string   `json:"eventId"`
+		EventType    string   `json:"eventType"`
+		EventStatus  string   `json:"eventStatus"`
+		ResourceType string   `json:"resourceType"`
+		Resources    []string `json:"resources"`
+		NotBefore    string   `json:"notBefore"`
+		Description  string   `json:"description"`
+	}
+)
+
+// sends new events to webhook (async, failures don't affect collection)
+func sendWebhook(ctx context.Context, target *ApiTarget, events []AzureScheduledEvent) {
+	if opts.WebhookUrl == "" || len(events) == 0 {
+		return
+	}
+
+	payload := AzureScheduledEventWebhook{
+		Target: target.Url,
+		Time:   time.Now().UTC(),
+		Events: []AzureScheduledEventHook{},
+	}
+	for _, event := range events {
+		payload.Events = append(payload.Events, AzureScheduledEventHook{
+			EventId:      event.EventId,
+			EventType:    event.EventType,
+			EventStatus:  event.EventStatus,
+			ResourceType: event.ResourceType,
+			Resources:    event.Resources,
+			NotBefore:    event.NotBefore,
+			Description:  event.Description,
+		})
+	}
+
+	go func() {
+		release, err := acquireAction(ctx)
+		if err != nil {
+			scrapeLogger(ctx).WithField("url", target.Url).Debugf("webhook for %v new events cancelled: %v", len(payload.Events), err)
+			return
+		}
+		defer release()
+
+		err = postWebhook(ctx, payload)
+		countAction(ctx, "webhook", err)
+		if err != nil {
+			scrapeLogger(ctx).WithField("url", target.Url).Errorf("failed to send webhook for %v new events: %v", len(payload.Events), err)
+			scheduledEventWebhookErrors.WithLabelValues().Inc()
+			return
+		}
+		scrapeLogger(ctx).WithField("url", target.Url).Debugf("sent webhook for %v new events", len(payload.Events))
+	}()
+}
+
+func postWebhook(ctx context.Context, payload AzureScheduledEventWebhook) error {
+	ctx, cancel := context.WithTimeout(ctx, opts.WebhookTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", opts.WebhookUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", opts.UserAgent)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, apiErrorBodyLimit))
+		return fmt.Errorf("unexpected status %v from webhook: %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+
+	return nil
+}